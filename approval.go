@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// hash of the aggregate waiting for approval, set on the target
+	pendingAnnotation = "configmap-aggregator/pending"
+	// keys the pending aggregate changes, set on the target
+	pendingChangesAnnotation = "configmap-aggregator/pending-changes"
+	// set on the target by an operator to the pending hash to apply it
+	approveAnnotation = "configmap-aggregator/approve"
+)
+
+// approved reports whether cm may be written to the target. Changes to an
+// existing target are recorded in annotations on it and only applied once
+// an operator approves them by setting the approve annotation to their hash.
+func (c *controller) approved(cm *ConfigMap) (bool, error) {
+	existing, err := c.client.getConfigMap(c.targetNamespace, c.targetName)
+	if err == ErrNotExist {
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get config map %s/%s", c.targetNamespace, c.targetName)
+	}
+
+	merged, err := cloneConfigMap(cm)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to copy aggregate")
+	}
+	if err := c.mergeExisting(existing, merged); err != nil {
+		return false, err
+	}
+	changes := c.diff(existing, merged)
+	if changes.empty() {
+		return true, nil
+	}
+
+	hash := hashConfigMap(cm)
+	if existing.Metadata.Annotations[approveAnnotation] == hash {
+		c.logf("applying approved changes %s", hash)
+		return true, nil
+	}
+	if existing.Metadata.Annotations[pendingAnnotation] == hash {
+		return false, nil
+	}
+
+	keys, err := json.Marshal(changes)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to encode pending changes")
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				pendingAnnotation:        hash,
+				pendingChangesAnnotation: string(keys),
+			},
+		},
+	}
+	if err := c.client.patchConfigMap(c.targetNamespace, c.targetName, mergePatchType, patch); err != nil {
+		return false, err
+	}
+	c.logf("changes %s are waiting for approval", hash)
+	c.recordEvent("Normal", "ApprovalRequired", "changes to %s are waiting for approval: set %s=%s to apply them", string(keys), approveAnnotation, hash)
+	return false, nil
+}
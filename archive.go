@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// archiveFormat returns the format of an archive from its name: tar.gz or zip.
+func archiveFormat(name string) (string, error) {
+	// ignore any query string of a url
+	if i := strings.Index(name, "?"); i >= 0 {
+		name = name[:i]
+	}
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz", nil
+	case strings.HasSuffix(name, ".zip"):
+		return "zip", nil
+	}
+	return "", errors.Errorf("unknown archive format of %s: expected .tar.gz, .tgz, or .zip", name)
+}
+
+func writeTarGz(w io.Writer, data map[string]string, mtime time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, k := range sortedKeys(data) {
+		hdr := &tar.Header{
+			Name:    k,
+			Mode:    0644,
+			Size:    int64(len(data[k])),
+			ModTime: mtime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, data[k]); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, data map[string]string, mtime time.Time) error {
+	zw := zip.NewWriter(w)
+	for _, k := range sortedKeys(data) {
+		hdr := &zip.FileHeader{
+			Name:     k,
+			Method:   zip.Deflate,
+			Modified: mtime,
+		}
+		f, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, data[k]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// publishArchive packages the aggregate into a single archive, written to
+// a local file or uploaded with an HTTP PUT, such as to a presigned S3 url.
+func (c *controller) publishArchive(cm *ConfigMap) error {
+	format, err := archiveFormat(c.archive)
+	if err != nil {
+		return err
+	}
+	data, err := decompressData(cm)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	contentType := "application/gzip"
+	if format == "zip" {
+		contentType = "application/zip"
+		err = writeZip(&buf, data, time.Now())
+	} else {
+		err = writeTarGz(&buf, data, time.Now())
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create archive")
+	}
+
+	if !strings.HasPrefix(c.archive, "http://") && !strings.HasPrefix(c.archive, "https://") {
+		if err := writeFile(c.archive, buf.Bytes()); err != nil {
+			return errors.Wrapf(err, "failed to write archive %s", c.archive)
+		}
+		c.logf("wrote %d keys to %s", len(data), c.archive)
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.archive, &buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to create archive upload request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload archive")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("archive upload returned HTTP %v", resp.StatusCode)
+	}
+	c.logf("uploaded %d keys to archive", len(data))
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cachingLister shares lists of another lister between rules for ttl, so
+// rules with the same sources do not repeat identical list calls. Watch
+// events invalidate the cache.
+type cachingLister struct {
+	ConfigMapLister
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*listCacheEntry
+	// incremented on invalidation, so lists started before are not cached
+	generation int
+}
+
+type listCacheEntry struct {
+	// encoded so each caller gets its own copy
+	list    []byte
+	expires time.Time
+}
+
+func newCachingLister(l ConfigMapLister, ttl time.Duration) *cachingLister {
+	return &cachingLister{
+		ConfigMapLister: l,
+		ttl:             ttl,
+		entries:         make(map[string]*listCacheEntry),
+	}
+}
+
+func (l *cachingLister) List(namespace, selector string) (*ConfigMapList, error) {
+	key := namespace + "\x00" + selector
+	l.mu.Lock()
+	e, ok := l.entries[key]
+	generation := l.generation
+	l.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		list, err := l.ConfigMapLister.List(namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			return nil, err
+		}
+		e = &listCacheEntry{list: b, expires: time.Now().Add(l.ttl)}
+		l.mu.Lock()
+		if l.generation == generation {
+			l.entries[key] = e
+		}
+		l.mu.Unlock()
+	}
+
+	var list ConfigMapList
+	if err := json.Unmarshal(e.list, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (l *cachingLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	w, ok := l.ConfigMapLister.(watcher)
+	if !ok {
+		return errors.New("source does not support watching")
+	}
+	return w.watch(namespace, selector, done, func(e WatchEvent) {
+		l.mu.Lock()
+		l.entries = make(map[string]*listCacheEntry)
+		l.generation++
+		l.mu.Unlock()
+		fn(e)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	lineEndingsKeep = "keep"
+	lineEndingsLF   = "lf"
+
+	trailingNewlineKeep   = "keep"
+	trailingNewlineAdd    = "add"
+	trailingNewlineStrip  = "strip"
+	trailingNewlineSingle = "single"
+)
+
+func validateCanonicalOptions(lineEndings, trailingNewline string) error {
+	switch lineEndings {
+	case lineEndingsKeep, lineEndingsLF:
+	default:
+		return errors.Errorf("invalid line endings policy %q", lineEndings)
+	}
+	switch trailingNewline {
+	case trailingNewlineKeep, trailingNewlineAdd, trailingNewlineStrip, trailingNewlineSingle:
+	default:
+		return errors.Errorf("invalid trailing newline policy %q", trailingNewline)
+	}
+	return nil
+}
+
+// canonicalize normalizes a value so that semantically identical sources
+// produce identical aggregates.
+func (c *controller) canonicalize(v string) string {
+	if c.lineEndings == lineEndingsLF {
+		v = strings.Replace(v, "\r\n", "\n", -1)
+	}
+
+	switch c.trailingNewline {
+	case trailingNewlineAdd:
+		if !strings.HasSuffix(v, "\n") {
+			v = v + "\n"
+		}
+	case trailingNewlineStrip:
+		v = strings.TrimRight(v, "\r\n")
+	case trailingNewlineSingle:
+		v = strings.TrimRight(v, "\r\n") + "\n"
+	}
+	return v
+}
+
+// sortedKeys returns the keys of data in order, so aggregation does not
+// depend on map iteration order.
+func sortedKeys(data map[string]string) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
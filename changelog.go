@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// changelogFile in the output directory holds one JSON line for each sync
+// that changed files, newest last.
+const changelogFile = "CHANGELOG.jsonl"
+
+type changelogEntry struct {
+	Time     time.Time `json:"time"`
+	Hash     string    `json:"hash"`
+	Added    []string  `json:"added,omitempty"`
+	Modified []string  `json:"modified,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+}
+
+// appendChangelog records changes in the changelog, keeping only the most
+// recent changelogEntries lines.
+func (c *controller) appendChangelog(cm *ConfigMap, changes *changeSet) error {
+	if c.changelogEntries <= 0 || changes.empty() {
+		return nil
+	}
+	name := filepath.Join(c.outputDir, changelogFile)
+	data, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to read changelog")
+	}
+
+	line, err := json.Marshal(&changelogEntry{
+		Time:     time.Now().UTC(),
+		Hash:     hashConfigMap(cm),
+		Added:    changes.Added,
+		Modified: changes.Modified,
+		Removed:  changes.Removed,
+	})
+	if err != nil {
+		return err
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if n := len(lines); n > 0 && len(lines[n-1]) == 0 {
+		lines = lines[:n-1]
+	}
+	lines = append(lines, append(line, '\n'))
+	if n := len(lines) - c.changelogEntries; n > 0 {
+		lines = lines[n:]
+	}
+	if err := writeFile(name, bytes.Join(lines, nil)); err != nil {
+		return errors.Wrap(err, "failed to write changelog")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"sort"
+)
+
+// changeSet lists the keys that differ between the target and the aggregate.
+type changeSet struct {
+	Added    []string `json:"added,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+func (s *changeSet) empty() bool {
+	return s == nil || len(s.Added)+len(s.Modified)+len(s.Removed) == 0
+}
+
+// keys returns every changed key in order.
+func (s *changeSet) keys() []string {
+	if s == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(s.Added)+len(s.Modified)+len(s.Removed))
+	keys = append(keys, s.Added...)
+	keys = append(keys, s.Modified...)
+	keys = append(keys, s.Removed...)
+	sort.Strings(keys)
+	return keys
+}
+
+// diff returns the changes needed to turn existing into cm. Values are
+// compared using the configured compare mode.
+func (c *controller) diff(existing, cm *ConfigMap) *changeSet {
+	s := &changeSet{}
+	seen := make(map[string]bool)
+
+	for k, v := range cm.Data {
+		seen[k] = true
+		if old, ok := existing.Data[k]; ok {
+			if !c.valuesEqual(old, v) {
+				s.Modified = append(s.Modified, k)
+			}
+			continue
+		}
+		if old, ok := existing.BinaryData[k]; ok {
+			if !bytes.Equal(old, []byte(v)) {
+				s.Modified = append(s.Modified, k)
+			}
+			continue
+		}
+		s.Added = append(s.Added, k)
+	}
+	for k := range cm.BinaryData {
+		seen[k] = true
+		if _, ok := existing.BinaryData[k]; ok {
+			if !c.binaryValuesEqual(k, existing, cm) {
+				s.Modified = append(s.Modified, k)
+			}
+			continue
+		}
+		if _, ok := existing.Data[k]; ok {
+			s.Modified = append(s.Modified, k)
+			continue
+		}
+		s.Added = append(s.Added, k)
+	}
+	for k := range existing.Data {
+		if !seen[k] {
+			s.Removed = append(s.Removed, k)
+		}
+	}
+	for k := range existing.BinaryData {
+		if !seen[k] {
+			s.Removed = append(s.Removed, k)
+		}
+	}
+
+	sort.Strings(s.Added)
+	sort.Strings(s.Modified)
+	sort.Strings(s.Removed)
+	return s
+}
+
+// filter returns the changes to keys matching any of the glob patterns.
+func (s *changeSet) filter(patterns []string) *changeSet {
+	if s == nil || len(patterns) == 0 {
+		return s
+	}
+	match := func(keys []string) []string {
+		var out []string
+		for _, k := range keys {
+			for _, p := range patterns {
+				if ok, _ := path.Match(p, k); ok {
+					out = append(out, k)
+					break
+				}
+			}
+		}
+		return out
+	}
+	return &changeSet{
+		Added:    match(s.Added),
+		Modified: match(s.Modified),
+		Removed:  match(s.Removed),
+	}
+}
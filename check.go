@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// commandTimeout bounds how long a check or transform command may run.
+const commandTimeout = time.Minute
+
+// runCommand runs command with {} replaced by file. Without {}, file, if
+// any, is added as the last argument. It returns the standard output.
+func runCommand(command, file string, stdin []byte) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	found := false
+	for i, a := range args {
+		if strings.Contains(a, "{}") {
+			args[i] = strings.Replace(a, "{}", file, -1)
+			found = true
+		}
+	}
+	if !found && file != "" {
+		args = append(args, file)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()+stdout.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// checkValue writes value to a temporary file named after key and runs the
+// check command on it. {} in the command is replaced by the file, which is
+// otherwise added as the last argument. A non zero exit rejects the value.
+func (c *controller) checkValue(key, value string) error {
+	dir, err := ioutil.TempDir("", "configmap-aggregator")
+	if err != nil {
+		return errors.Wrap(err, "failed to create check directory")
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, path.Base(key))
+	if err := ioutil.WriteFile(file, []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", file)
+	}
+	if _, err := runCommand(c.checkCommand, file, nil); err != nil {
+		return errors.Wrapf(err, "check of %s failed", key)
+	}
+	return nil
+}
+
+// transform runs the transform command on the aggregate and returns its
+// result. If the command contains {}, it is replaced by a directory holding
+// a file per key, which the command modifies in place. Otherwise the command
+// reads the aggregate as a JSON object of keys and values from standard
+// input and writes the result the same way to standard output.
+func (c *controller) transform(data map[string]string) (map[string]string, error) {
+	if !strings.Contains(c.transformCommand, "{}") {
+		in, err := json.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode aggregate")
+		}
+		out, err := runCommand(c.transformCommand, "", in)
+		if err != nil {
+			return nil, errors.Wrap(err, "transform failed")
+		}
+		var result map[string]string
+		if err := json.Unmarshal(out, &result); err != nil {
+			return nil, errors.Wrap(err, "transform did not return a JSON object of strings")
+		}
+		return c.transformedKeys(result)
+	}
+
+	dir, err := ioutil.TempDir("", "configmap-aggregator")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create transform directory")
+	}
+	defer os.RemoveAll(dir)
+
+	for k, v := range data {
+		file := filepath.Join(dir, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return nil, errors.Wrapf(err, "failed to create directory for %s", k)
+		}
+		if err := ioutil.WriteFile(file, []byte(v), 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s", file)
+		}
+	}
+	if _, err := runCommand(c.transformCommand, dir, nil); err != nil {
+		return nil, errors.Wrap(err, "transform failed")
+	}
+
+	result := make(map[string]string)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		v, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		result[filepath.ToSlash(rel)] = string(v)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read transformed files")
+	}
+	return c.transformedKeys(result)
+}
+
+// transformedKeys drops keys added by a transform that are not valid.
+func (c *controller) transformedKeys(data map[string]string) (map[string]string, error) {
+	check := validateKey
+	if c.outputDir != "" {
+		check = validatePath
+	}
+	for k := range data {
+		if err := check(k); err != nil {
+			if err := c.warn("skipping invalid key %q from transform: %v", k, err); err != nil {
+				return nil, err
+			}
+			delete(data, k)
+		}
+	}
+	return data, nil
+}
+
+// validateCommandData is passed to the validate command template.
+type validateCommandData struct {
+	// directory holding a file per key of the candidate output
+	Dir string
+}
+
+func parseValidateCommand(s string) (*template.Template, error) {
+	t, err := template.New("validate").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid validate command %q", s)
+	}
+	return t, nil
+}
+
+// validateOutput writes the candidate output to a temporary directory and
+// runs the validate command on it, so a broken configuration never reaches
+// consumers. An aggregate that already passed is not validated again.
+func (c *controller) validateOutput(cm *ConfigMap) error {
+	hash := hashConfigMap(cm)
+	if hash == c.validatedHash {
+		return nil
+	}
+
+	data, err := decompressData(cm)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "configmap-aggregator")
+	if err != nil {
+		return errors.Wrap(err, "failed to create validation directory")
+	}
+	defer os.RemoveAll(dir)
+	for k, v := range data {
+		file := filepath.Join(dir, filepath.FromSlash(k))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return errors.Wrapf(err, "failed to create directory for %s", k)
+		}
+		if err := ioutil.WriteFile(file, []byte(v), 0644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", file)
+		}
+	}
+
+	var command bytes.Buffer
+	if err := c.validateCommand.Execute(&command, &validateCommandData{Dir: dir}); err != nil {
+		return errors.Wrap(err, "failed to execute validate command template")
+	}
+	if _, err := runCommand(command.String(), "", nil); err != nil {
+		c.recordEvent("Warning", "ValidationFailed", "aggregate rejected by validate command: %v", err)
+		return errors.Wrap(err, "aggregate rejected by validate command")
+	}
+	c.validatedHash = hash
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	compareExact    = "exact"
+	compareTrim     = "trim"
+	compareSemantic = "semantic"
+)
+
+func validateCompareMode(mode string) error {
+	switch mode {
+	case compareExact, compareTrim, compareSemantic:
+		return nil
+	}
+	return errors.Errorf("invalid compare mode %q", mode)
+}
+
+// parseVolatilePatterns compiles the patterns of substrings, such as
+// timestamps, that are removed from values before they are compared.
+func parseVolatilePatterns(specs []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, spec := range specs {
+		re, err := regexp.Compile(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ignore pattern %q", spec)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// exactCompare is true if values are compared byte for byte, so hashes can
+// be compared instead.
+func (c *controller) exactCompare() bool {
+	return (c.compareMode == compareExact || c.compareMode == "") && len(c.volatilePatterns) == 0
+}
+
+// valuesEqual compares two values using the configured mode. In semantic
+// mode, values that are both valid JSON are compared as documents and
+// anything else is compared with surrounding whitespace trimmed. Volatile
+// substrings are removed first.
+func (c *controller) valuesEqual(a, b string) bool {
+	for _, re := range c.volatilePatterns {
+		a = re.ReplaceAllString(a, "")
+		b = re.ReplaceAllString(b, "")
+	}
+	switch c.compareMode {
+	case compareTrim:
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	case compareSemantic:
+		var x, y interface{}
+		if json.Unmarshal([]byte(a), &x) == nil && json.Unmarshal([]byte(b), &y) == nil {
+			return reflect.DeepEqual(x, y)
+		}
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	return a == b
+}
+
+// binaryValuesEqual compares the binaryData of key in a and b. Values that
+// are compressed in both are decompressed and compared like data, anything
+// else byte for byte.
+func (c *controller) binaryValuesEqual(key string, a, b *ConfigMap) bool {
+	if !c.exactCompare() {
+		if x, ok := compressedValue(a, key); ok {
+			if y, ok := compressedValue(b, key); ok {
+				return c.valuesEqual(x, y)
+			}
+		}
+	}
+	return bytes.Equal(a.BinaryData[key], b.BinaryData[key])
+}
+
+// configMapsEqual is true if the data of a and b is the same.
+func (c *controller) configMapsEqual(a, b *ConfigMap) bool {
+	if c.exactCompare() {
+		return compareConfigMaps(a, b)
+	}
+
+	if len(a.Data) != len(b.Data) || len(a.BinaryData) != len(b.BinaryData) {
+		return false
+	}
+	for k, v := range a.Data {
+		other, ok := b.Data[k]
+		if !ok || !c.valuesEqual(v, other) {
+			return false
+		}
+	}
+	for k := range a.BinaryData {
+		if _, ok := b.BinaryData[k]; !ok || !c.binaryValuesEqual(k, a, b) {
+			return false
+		}
+	}
+	return true
+}
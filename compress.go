@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// compressedAnnotation lists the keys of binaryData that hold gzipped values.
+const compressedAnnotation = "configmap-aggregator/compressed"
+
+// compress moves values larger than compressThreshold into binaryData,
+// gzipped, so more data fits under the config map size limit.
+func (c *controller) compress(cm *ConfigMap) error {
+	if c.compressThreshold <= 0 {
+		return nil
+	}
+
+	var keys []string
+	for k, v := range cm.Data {
+		if len(v) <= c.compressThreshold {
+			continue
+		}
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write([]byte(v)); err != nil {
+			return errors.Wrapf(err, "failed to compress %s", k)
+		}
+		if err := w.Close(); err != nil {
+			return errors.Wrapf(err, "failed to compress %s", k)
+		}
+		if cm.BinaryData == nil {
+			cm.BinaryData = make(map[string][]byte)
+		}
+		cm.BinaryData[k] = buf.Bytes()
+		delete(cm.Data, k)
+		keys = append(keys, k)
+	}
+
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		cm.Metadata.Annotations[compressedAnnotation] = strings.Join(keys, ",")
+	}
+	return nil
+}
+
+// decompressData returns the data of cm with any compressed values restored.
+func decompressData(cm *ConfigMap) (map[string]string, error) {
+	data := make(map[string]string, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = v
+	}
+	if cm.Metadata.Annotations[compressedAnnotation] == "" {
+		return data, nil
+	}
+	for _, k := range strings.Split(cm.Metadata.Annotations[compressedAnnotation], ",") {
+		v, ok := cm.BinaryData[k]
+		if !ok {
+			continue
+		}
+		b, err := decompress(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress %s", k)
+		}
+		data[k] = b
+	}
+	return data, nil
+}
+
+func decompress(v []byte) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// compressedValue returns the binaryData value of key decompressed, if cm
+// lists it as compressed.
+func compressedValue(cm *ConfigMap, key string) (string, bool) {
+	v, ok := cm.BinaryData[key]
+	if !ok {
+		return "", false
+	}
+	for _, k := range strings.Split(cm.Metadata.Annotations[compressedAnnotation], ",") {
+		if k == key {
+			b, err := decompress(v)
+			return b, err == nil
+		}
+	}
+	return "", false
+}
+
+// encodeBinaryData base64 encodes values the way the API expects them.
+func encodeBinaryData(data map[string][]byte) map[string]string {
+	encoded := make(map[string]string, len(data))
+	for k, v := range data {
+		encoded[k] = base64.StdEncoding.EncodeToString(v)
+	}
+	return encoded
+}
@@ -0,0 +1,76 @@
+package main
+
+import "sync"
+
+// sourceContribution is what a source contributes to the aggregate at a
+// resource version.
+type sourceContribution struct {
+	version string
+	entries []sourceEntry
+	// names of entries whose values passed validation
+	valid map[string]bool
+}
+
+// contributionCache keeps the contribution of each source between syncs, so
+// only sources that changed are turned into entries and validated again.
+type contributionCache struct {
+	mu      sync.Mutex
+	sources map[string]*sourceContribution
+	seen    map[string]bool
+}
+
+func newContributionCache() *contributionCache {
+	return &contributionCache{
+		sources: make(map[string]*sourceContribution),
+		seen:    make(map[string]bool),
+	}
+}
+
+func contributionKey(cm *ConfigMap) string {
+	return cm.Metadata.Annotations[sourceAnnotation] + "/" + cm.Metadata.Namespace + "/" + cm.Metadata.Name
+}
+
+// contribution returns the contribution of cm, from the cache if cm did not
+// change since the last sync. Sources without a resource version are never
+// cached.
+func (c *controller) contribution(cm *ConfigMap) (*sourceContribution, error) {
+	cache := c.contributions
+	version := cm.Metadata.ResourceVersion
+	if cache != nil && version != "" {
+		key := contributionKey(cm)
+		cache.mu.Lock()
+		cache.seen[key] = true
+		s, ok := cache.sources[key]
+		cache.mu.Unlock()
+		if ok && s.version == version {
+			return s, nil
+		}
+	}
+
+	entries, err := c.sourceEntries(cm)
+	if err != nil {
+		return nil, err
+	}
+	s := &sourceContribution{version: version, entries: entries, valid: make(map[string]bool)}
+	if cache != nil && version != "" {
+		cache.mu.Lock()
+		cache.sources[contributionKey(cm)] = s
+		cache.mu.Unlock()
+	}
+	return s, nil
+}
+
+// prune forgets the sources that were not part of the last aggregate.
+func (cache *contributionCache) prune() {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for k := range cache.sources {
+		if !cache.seen[k] {
+			delete(cache.sources, k)
+		}
+	}
+	cache.seen = make(map[string]bool)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// corefileZones returns the zones of the server blocks of a Corefile
+// fragment, checking that it only holds complete server blocks.
+func corefileZones(fragment string) ([]string, error) {
+	var zones []string
+	var header bytes.Buffer
+	depth := 0
+	quoted := false
+	for _, line := range strings.Split(fragment, "\n") {
+		for i := 0; i < len(line); i++ {
+			ch := line[i]
+			if quoted {
+				if ch == '\\' {
+					i++
+				} else if ch == '"' {
+					quoted = false
+				}
+				continue
+			}
+			switch ch {
+			case '"':
+				quoted = true
+			case '#':
+				i = len(line)
+			case '{':
+				if depth == 0 {
+					keys := strings.Fields(header.String())
+					if len(keys) == 0 {
+						return nil, errors.New("server block without a zone")
+					}
+					zones = append(zones, keys...)
+					header.Reset()
+				}
+				depth++
+			case '}':
+				if depth == 0 {
+					return nil, errors.New("unexpected }")
+				}
+				depth--
+			default:
+				if depth == 0 {
+					header.WriteByte(ch)
+				}
+			}
+		}
+		if depth == 0 {
+			header.WriteByte(' ')
+		}
+	}
+	if depth > 0 || quoted {
+		return nil, errors.New("unterminated server block")
+	}
+	if s := strings.TrimSpace(header.String()); s != "" {
+		return nil, errors.Errorf("%q is outside of a server block", s)
+	}
+	return zones, nil
+}
+
+// corefileZone normalizes a server block key the way CoreDNS does, so
+// "example.org", "Example.org." and "dns://example.org:53" are the same zone.
+func corefileZone(key string) string {
+	z := strings.ToLower(strings.TrimPrefix(key, "dns://"))
+	port := "53"
+	if i := strings.LastIndex(z, ":"); i >= 0 {
+		if _, err := strconv.Atoi(z[i+1:]); err == nil {
+			z, port = z[:i], z[i+1:]
+		}
+	}
+	if !strings.HasSuffix(z, ".") {
+		z += "."
+	}
+	return z + ":" + port
+}
+
+// corefileFragment is a server block contributed by a source key.
+type corefileFragment struct {
+	key   string
+	zones []string
+	text  string
+}
+
+// mergeCorefile joins Corefile server blocks in order. Fragments that
+// are not complete server blocks, or that serve a zone another fragment
+// already serves, are skipped. The fragments are kept so they can be checked
+// against the zones of the existing Corefile when it is spliced.
+func (c *controller) mergeCorefile(keys []string, data map[string]string) (string, error) {
+	var fragments []corefileFragment
+	seen := make(map[string]string)
+	for _, k := range keys {
+		zones, err := corefileZones(data[k])
+		if err == nil {
+			for _, z := range zones {
+				if other, ok := seen[corefileZone(z)]; ok {
+					err = errors.Errorf("%s is already served by %s", z, other)
+					break
+				}
+			}
+		}
+		if err != nil {
+			if err := c.warn("skipping Corefile fragment %s: %v", k, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+		for _, z := range zones {
+			seen[corefileZone(z)] = k
+		}
+		fragments = append(fragments, corefileFragment{key: k, zones: zones, text: data[k]})
+	}
+	c.corefileFragments = fragments
+	return joinCorefile(fragments), nil
+}
+
+func joinCorefile(fragments []corefileFragment) string {
+	var buf bytes.Buffer
+	for _, f := range fragments {
+		buf.WriteString("# " + f.key + "\n")
+		buf.WriteString(strings.TrimRight(f.text, "\n") + "\n")
+	}
+	return buf.String()
+}
+
+// spliceCorefile splices the merged fragments into the existing Corefile,
+// skipping fragments serving a zone that the rest of the Corefile already
+// serves, as CoreDNS refuses to load a Corefile with duplicate zones. A
+// conflict is logged and recorded once, when it first appears.
+func (c *controller) spliceCorefile(existing string) (string, error) {
+	served := make(map[string]bool)
+	zones, err := corefileZones(c.unmarked(existing))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse the existing Corefile")
+	}
+	for _, z := range zones {
+		served[corefileZone(z)] = true
+	}
+
+	var fragments []corefileFragment
+	conflicts := make(map[string]bool)
+FRAGMENTS:
+	for _, f := range c.corefileFragments {
+		for _, z := range f.zones {
+			if !served[corefileZone(z)] {
+				continue
+			}
+			if !c.corefileConflicts[f.key] || c.strict {
+				if err := c.warn("skipping Corefile fragment %s: %s is already served by the existing Corefile", f.key, z); err != nil {
+					return "", err
+				}
+				c.recordEvent("Warning", "ZoneConflict", "skipped Corefile fragment %s: %s is already served by the existing Corefile", f.key, z)
+			}
+			conflicts[f.key] = true
+			continue FRAGMENTS
+		}
+		fragments = append(fragments, f)
+	}
+	c.corefileConflicts = conflicts
+	return c.spliceMarked(existing, joinCorefile(fragments)), nil
+}
+
+// unmarked returns existing without the markers of this rule and the part
+// between them.
+func (c *controller) unmarked(existing string) string {
+	begin, end := c.markers()
+	i := strings.Index(existing, begin)
+	j := strings.Index(existing, end)
+	if i < 0 || j < i {
+		return existing
+	}
+	return existing[:i] + existing[j+len(end):]
+}
+
+func (c *controller) markers() (string, string) {
+	return "# BEGIN configmap-aggregator " + c.name + "\n", "# END configmap-aggregator " + c.name + "\n"
+}
+
+// spliceMarked replaces the part of existing between the markers of this
+// rule with value, appending the markers if they are missing.
+func (c *controller) spliceMarked(existing, value string) string {
+	begin, end := c.markers()
+	block := begin + value + end
+
+	i := strings.Index(existing, begin)
+	j := strings.Index(existing, end)
+	if i < 0 || j < i {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing = existing + "\n"
+		}
+		return existing + block
+	}
+	return existing[:i] + block + existing[j+len(end):]
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCorefileZones(t *testing.T) {
+	tests := []struct {
+		fragment string
+		zones    []string
+		err      bool
+	}{
+		{fragment: "", zones: nil},
+		{fragment: "example.org {\n  forward . 10.0.0.1\n}\n", zones: []string{"example.org"}},
+		{fragment: "a.org b.org:5353 {\n  log\n}\n# comment\nc.org {\n  hosts {\n    10.0.0.1 x.c.org\n  }\n}\n", zones: []string{"a.org", "b.org:5353", "c.org"}},
+		{fragment: "example.org { # {\n  template IN A { answer \"{{ .Name }} 60 IN A 1.2.3.4 }\" }\n}\n", zones: []string{"example.org"}},
+		{fragment: "example.org\n{\n}\n", zones: []string{"example.org"}},
+		{fragment: "{\n}\n", err: true},
+		{fragment: "example.org {\n", err: true},
+		{fragment: "}\n", err: true},
+		{fragment: "forward . 10.0.0.1\n", err: true},
+		{fragment: "example.org {\n  log \"unterminated\n}\n", err: true},
+	}
+	for _, tt := range tests {
+		zones, err := corefileZones(tt.fragment)
+		if tt.err {
+			if err == nil {
+				t.Errorf("corefileZones(%q) succeeded, expected an error", tt.fragment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("corefileZones(%q): %v", tt.fragment, err)
+			continue
+		}
+		if !reflect.DeepEqual(zones, tt.zones) {
+			t.Errorf("corefileZones(%q) = %q, expected %q", tt.fragment, zones, tt.zones)
+		}
+	}
+}
+
+func TestCorefileZone(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "example.org", want: "example.org.:53"},
+		{key: "Example.org.", want: "example.org.:53"},
+		{key: "dns://example.org:53", want: "example.org.:53"},
+		{key: "example.org:5353", want: "example.org.:5353"},
+		{key: ".", want: ".:53"},
+		{key: ".:53", want: ".:53"},
+	}
+	for _, tt := range tests {
+		if got := corefileZone(tt.key); got != tt.want {
+			t.Errorf("corefileZone(%q) = %q, expected %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMergeCorefile(t *testing.T) {
+	data := map[string]string{
+		"a": "a.org {\n  log\n}",
+		"b": "A.org. {\n  errors\n}\n",
+		"c": "c.org {\n",
+		"d": "d.org {\n  cache\n}\n",
+	}
+	c := &controller{}
+	got, err := c.mergeCorefile(sortedKeys(data), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# a\na.org {\n  log\n}\n# d\nd.org {\n  cache\n}\n"
+	if got != want {
+		t.Errorf("mergeCorefile = %q, expected %q", got, want)
+	}
+
+	c = &controller{strict: true}
+	if _, err := c.mergeCorefile(sortedKeys(data), data); err == nil {
+		t.Error("mergeCorefile with invalid fragments succeeded in strict mode")
+	}
+}
+
+func TestSpliceCorefile(t *testing.T) {
+	fragments := map[string]string{
+		"a": "a.org {\n  log\n}\n",
+		"b": "dns://cluster.local {\n  log\n}\n",
+	}
+	tests := []struct {
+		existing string
+		want     string
+		err      bool
+	}{
+		{
+			existing: "",
+			want:     "# BEGIN configmap-aggregator r\n# a\na.org {\n  log\n}\n# b\ndns://cluster.local {\n  log\n}\n# END configmap-aggregator r\n",
+		},
+		{
+			// the zone of b is already served outside of the markers
+			existing: ".:53 {\n  kubernetes cluster.local\n}\ncluster.local:53 {\n  errors\n}",
+			want:     ".:53 {\n  kubernetes cluster.local\n}\ncluster.local:53 {\n  errors\n}\n# BEGIN configmap-aggregator r\n# a\na.org {\n  log\n}\n# END configmap-aggregator r\n",
+		},
+		{
+			// the zones of an earlier merge do not conflict
+			existing: ".:53 {\n}\n# BEGIN configmap-aggregator r\n# b\ncluster.local {\n}\n# END configmap-aggregator r\n# after\n",
+			want:     ".:53 {\n}\n# BEGIN configmap-aggregator r\n# a\na.org {\n  log\n}\n# b\ndns://cluster.local {\n  log\n}\n# END configmap-aggregator r\n# after\n",
+		},
+		{existing: ".:53 {\n", err: true},
+	}
+	for _, tt := range tests {
+		c := &controller{name: "r"}
+		if _, err := c.mergeCorefile(sortedKeys(fragments), fragments); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.spliceCorefile(tt.existing)
+		if tt.err {
+			if err == nil {
+				t.Errorf("spliceCorefile(%q) succeeded, expected an error", tt.existing)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("spliceCorefile(%q): %v", tt.existing, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("spliceCorefile(%q) = %q, expected %q", tt.existing, got, tt.want)
+		}
+	}
+}
+
+func TestSpliceCorefileConflicts(t *testing.T) {
+	fragments := map[string]string{"b": "cluster.local {\n}\n"}
+	existing := "cluster.local {\n}\n"
+
+	c := &controller{name: "r"}
+	if _, err := c.mergeCorefile(sortedKeys(fragments), fragments); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.spliceCorefile(existing); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.corefileConflicts, map[string]bool{"b": true}) {
+			t.Errorf("conflicts after splice %d = %v, expected b", i+1, c.corefileConflicts)
+		}
+	}
+
+	// strict mode fails on every sync, not only the first
+	c.strict = true
+	if _, err := c.spliceCorefile(existing); err == nil {
+		t.Error("spliceCorefile with a conflict succeeded in strict mode")
+	}
+}
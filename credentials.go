@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	tokenFile      string
+	apiCAFile      string
+	execCredential string
+)
+
+// tokenReloadInterval is how often the token file is read again. Bound
+// service account tokens are rotated by the kubelet well before they expire,
+// so a minute is plenty.
+const tokenReloadInterval = time.Minute
+
+// credentials provides the bearer token for API requests, either from a file
+// that is reloaded as it is rotated or from an exec credential plugin that is
+// run again before its token expires.
+type credentials struct {
+	tokenFile string
+	exec      []string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// execCredentialStatus is the part of an ExecCredential the aggregator
+// understands.
+type execCredentialStatus struct {
+	Status struct {
+		Token               string `json:"token"`
+		ExpirationTimestamp string `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+const execInfo = `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","spec":{"interactive":false}}`
+
+func newCredentials(tokenFile, command string) (*credentials, error) {
+	if tokenFile != "" && command != "" {
+		return nil, errors.New("token-file and exec-credential can not be used together")
+	}
+	if tokenFile == "" && command == "" {
+		return nil, nil
+	}
+	return &credentials{tokenFile: tokenFile, exec: strings.Fields(command)}, nil
+}
+
+// bearer returns the current token, refreshing it when it is due.
+func (c *credentials) bearer() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expiry) {
+		return c.token, nil
+	}
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read token from %s", c.tokenFile)
+		}
+		c.token = string(bytes.TrimSpace(data))
+		c.expiry = time.Now().Add(tokenReloadInterval)
+		return c.token, nil
+	}
+
+	cmd := exec.Command(c.exec[0], c.exec[1:]...)
+	cmd.Env = append(os.Environ(), "KUBERNETES_EXEC_INFO="+execInfo)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run exec credential plugin %s", c.exec[0])
+	}
+	var cred execCredentialStatus
+	if err := json.Unmarshal(out, &cred); err != nil {
+		return "", errors.Wrapf(err, "failed to decode output of exec credential plugin %s", c.exec[0])
+	}
+	if cred.Status.Token == "" {
+		return "", errors.Errorf("exec credential plugin %s returned no token", c.exec[0])
+	}
+	c.token = cred.Status.Token
+	// without an expiration the token is used until the API server rejects it
+	c.expiry = time.Now().Add(24 * time.Hour)
+	if cred.Status.ExpirationTimestamp != "" {
+		t, err := time.Parse(time.RFC3339, cred.Status.ExpirationTimestamp)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid expiration from exec credential plugin %s", c.exec[0])
+		}
+		// refresh a little early so requests in flight do not fail
+		c.expiry = t.Add(-30 * time.Second)
+	}
+	return c.token, nil
+}
+
+// invalidate forces the token to be refreshed before the next request, such
+// as after the API server rejected it.
+func (c *credentials) invalidate() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
+
+// clientOptions are how a client authenticates to an API server.
+type clientOptions struct {
+	tokenFile      string
+	execCredential string
+	caFile         string
+	certFile       string
+	keyFile        string
+}
+
+// newAPIClient returns a client for an endpoint of the primary cluster,
+// authenticated with the token file or exec credential plugin if one is
+// configured.
+func newAPIClient(endpoint string) (*k8sClient, error) {
+	return newClient(endpoint, clientOptions{tokenFile: tokenFile, execCredential: execCredential, caFile: apiCAFile})
+}
+
+// newClient returns a client for endpoint authenticated with opts.
+func newClient(endpoint string, opts clientOptions) (*k8sClient, error) {
+	client := newk8sClient(endpoint)
+	creds, err := newCredentials(opts.tokenFile, opts.execCredential)
+	if err != nil {
+		return nil, err
+	}
+	t := client.client.Transport.(*identifyingTransport)
+	t.credentials = creds
+	if opts.caFile != "" || opts.certFile != "" || opts.keyFile != "" {
+		next, err := transport(opts.caFile, opts.certFile, opts.keyFile, "")
+		if err != nil {
+			return nil, err
+		}
+		t.next = next
+	}
+	return client, nil
+}
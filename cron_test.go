@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		err      bool
+	}{
+		{field: "5", min: 0, max: 59, want: []int{5}},
+		{field: "1,3", min: 0, max: 59, want: []int{1, 3}},
+		{field: "1-4", min: 0, max: 59, want: []int{1, 2, 3, 4}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "10-20/5", min: 0, max: 59, want: []int{10, 15, 20}},
+		{field: "50/5", min: 0, max: 59, want: []int{50, 55}},
+		{field: "*", min: 1, max: 3, want: []int{1, 2, 3}},
+		{field: "60", min: 0, max: 59, err: true},
+		{field: "0", min: 1, max: 31, err: true},
+		{field: "5-1", min: 0, max: 59, err: true},
+		{field: "*/0", min: 0, max: 59, err: true},
+		{field: "a", min: 0, max: 59, err: true},
+		{field: "1-b", min: 0, max: 59, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.min, tt.max)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseCronField(%q) succeeded, expected an error", tt.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		want := make(map[int]bool)
+		for _, v := range tt.want {
+			want[v] = true
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parseCronField(%q) = %v, expected %v", tt.field, got, want)
+		}
+	}
+}
+
+func TestParseCronScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "@never", "* 24 * * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("parseCronSchedule(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{
+			spec: "*/15 * * * *",
+			from: time.Date(2020, 1, 1, 10, 7, 30, 0, time.UTC),
+			want: time.Date(2020, 1, 1, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			// a matching time is not returned again
+			spec: "0 * * * *",
+			from: time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+			want: time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			spec: "@daily",
+			from: time.Date(2020, 12, 31, 23, 59, 0, 0, time.UTC),
+			want: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec: "0 18 * * 5",
+			from: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2020, 1, 3, 18, 0, 0, 0, time.UTC),
+		},
+		{
+			// sunday as 7
+			spec: "0 0 * * 7",
+			from: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// either day field matches when both are restricted
+			spec: "0 0 15 * 1",
+			from: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2020, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			spec: "0 0 29 2 *",
+			from: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// hours are those of the location of from, not UTC
+			spec: "30 2 * * *",
+			from: time.Date(2020, 6, 1, 0, 0, 0, 0, berlin),
+			want: time.Date(2020, 6, 1, 2, 30, 0, 0, berlin),
+		},
+	}
+	for _, tt := range tests {
+		s, err := parseCronSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("next of %q after %v = %v, expected %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCronScheduleNextNeverMatches(t *testing.T) {
+	s, err := parseCronSchedule("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got, limit := s.next(from), from.Add(time.Minute).AddDate(5, 0, 0); !got.Equal(limit) {
+		t.Errorf("next of a schedule that never matches = %v, expected %v", got, limit)
+	}
+}
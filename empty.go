@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	emptyPolicyEmpty = "empty"
+	emptyPolicyKeep  = "keep"
+	emptyPolicyFail  = "fail"
+)
+
+// errNoSources is returned when the selector matches no config maps and the
+// empty policy does not allow emptying the target.
+var errNoSources = errors.New("no source config maps matched")
+
+func validateEmptyPolicy(policy string) error {
+	switch policy {
+	case emptyPolicyEmpty, emptyPolicyKeep, emptyPolicyFail:
+		return nil
+	}
+	return errors.Errorf("invalid empty policy %q", policy)
+}
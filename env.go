@@ -0,0 +1,49 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// what to do with keys that are not valid environment variable names, so
+// the target can be used with envFrom
+const (
+	envKeysRewrite = "rewrite"
+	envKeysReject  = "reject"
+)
+
+var (
+	validEnvName   = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+	invalidEnvChar = regexp.MustCompile(`[^A-Z0-9_]`)
+)
+
+func validateEnvKeys(mode string) error {
+	switch mode {
+	case "", envKeysRewrite, envKeysReject:
+		return nil
+	}
+	return errors.Errorf("invalid env keys mode %q", mode)
+}
+
+// envName rewrites name into an environment variable name: upper case,
+// with any other character replaced by an underscore.
+func envName(name string) string {
+	name = invalidEnvChar.ReplaceAllString(strings.ToUpper(name), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// envKey applies the env keys mode to an aggregated key.
+func (c *controller) envKey(name string) (string, error) {
+	switch {
+	case c.envKeys == "" || validEnvName.MatchString(name):
+		return name, nil
+	case c.envKeys == envKeysReject:
+		return "", errors.New("is not a valid environment variable name")
+	}
+	return envName(name), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// syncErrors collects the errors of a sync, so that every broken source is
+// reported at once rather than only the first.
+type syncErrors []error
+
+func (e *syncErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+// err returns nil if nothing was collected and the error itself if only
+// one was.
+func (e syncErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
+
+func (e syncErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// recordEvent creates an event on the target config map. Failures are only logged.
+func (c *controller) recordEvent(eventType, reason, format string, args ...interface{}) {
+	// there is no object to attach events to when writing files, and
+	// nothing is written in notify only mode
+	if c.targetName == "" || c.notifyOnly || c.dryRun {
+		return
+	}
+	now := time.Now()
+	e := &Event{
+		ApiVersion: "v1",
+		Kind:       "Event",
+		Metadata: Metadata{
+			GenerateName: c.targetName + ".",
+			Namespace:    c.targetNamespace,
+			Labels:       map[string]string{ruleLabel: c.ruleID},
+			Annotations:  map[string]string{ruleNameAnnotation: c.name},
+		},
+		InvolvedObject: c.targetRef(),
+		Reason:         reason,
+		Message:        fmt.Sprintf(format, args...),
+		Type:           eventType,
+		Source:         EventSource{Component: "configmap-aggregator"},
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+	}
+	if err := c.client.createEvent(e); err != nil {
+		c.logf("failed to record event %s: %v", reason, err)
+	}
+}
+
+// targetRef refers to the target config map or resource that events are
+// recorded on.
+func (c *controller) targetRef() ObjectReference {
+	ref := ObjectReference{
+		ApiVersion: "v1",
+		Kind:       "ConfigMap",
+		Namespace:  c.targetNamespace,
+		Name:       c.targetName,
+	}
+	if c.targetResource != nil {
+		ref.ApiVersion = c.targetResource.apiVersion()
+		ref.Kind = c.targetKind
+	}
+	return ref
+}
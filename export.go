@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [directory] [target-namespace] [target-name]",
+	Short: "write the aggregate as a kustomization with a configMapGenerator",
+	Run:   runExport,
+}
+
+var exportDir string
+
+// kustomizationTemplate lists a configMapGenerator for each rule, reading the
+// keys from files in a directory named after the target, so kustomize
+// generates hash suffixed config maps with the same data.
+var kustomizationTemplate = template.Must(template.New("kustomization").Parse(`apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+configMapGenerator:
+{{- range .}}
+- name: {{.Name}}
+  namespace: {{.Namespace}}
+  files:
+{{- range .Keys}}
+  - {{.}}
+{{- end}}
+{{- end}}
+`))
+
+type exportedTarget struct {
+	Name      string
+	Namespace string
+	Keys      []string
+}
+
+// exportTargets writes the keys of each aggregate and a kustomization.yaml
+// referencing them to dir.
+func exportTargets(dir string, targets map[*exportedTarget]*ConfigMap) error {
+	var list []*exportedTarget
+	for t, cm := range targets {
+		keyDir := filepath.Join(dir, t.Namespace, t.Name)
+		if err := os.MkdirAll(keyDir, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create %s", keyDir)
+		}
+		for k, v := range cm.Data {
+			t.Keys = append(t.Keys, k)
+			if err := ioutil.WriteFile(filepath.Join(keyDir, k), []byte(v), 0644); err != nil {
+				return errors.Wrapf(err, "failed to write %s", k)
+			}
+		}
+		for k, v := range cm.BinaryData {
+			t.Keys = append(t.Keys, k)
+			if err := ioutil.WriteFile(filepath.Join(keyDir, k), v, 0644); err != nil {
+				return errors.Wrapf(err, "failed to write %s", k)
+			}
+		}
+		sort.Strings(t.Keys)
+		for i, k := range t.Keys {
+			t.Keys[i] = t.Namespace + "/" + t.Name + "/" + k
+		}
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	var buf bytes.Buffer
+	if err := kustomizationTemplate.Execute(&buf, list); err != nil {
+		return err
+	}
+	file := filepath.Join(dir, "kustomization.yaml")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", file)
+	}
+	return nil
+}
+
+// exportAggregates aggregates each rule once and exports the results rather
+// than writing the targets.
+func exportAggregates(dir string, controllers []*controller) error {
+	targets := make(map[*exportedTarget]*ConfigMap)
+	for _, c := range controllers {
+		if c.targetName == "" {
+			return errors.Errorf("%s: export needs a target config map", c.name)
+		}
+		cm, err := c.aggregate()
+		if err != nil {
+			return errors.Wrapf(err, "failed to aggregate %s", c.name)
+		}
+		if cm == nil {
+			c.logf("nothing to export")
+			continue
+		}
+		targets[&exportedTarget{Name: c.targetName, Namespace: c.targetNamespace}] = cm
+	}
+	if err := exportTargets(dir, targets); err != nil {
+		return err
+	}
+	log.Printf("exported %d targets to %s", len(targets), dir)
+	return nil
+}
+
+// runExport aggregates once and writes a kustomization to a directory, so a
+// GitOps repository can take over the aggregate.
+func runExport(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatal("export directory is required")
+	}
+	exportDir = args[0]
+	onetime = true
+	// nothing but the export is written
+	dryRun = true
+	runAggregator(cmd, args[1:])
+}
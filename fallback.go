@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// fallbackLister lists from the primary lister and, when it fails, from
+// other endpoints of the same cluster in order, so sources can still be read
+// during control plane maintenance. Watches only use the primary.
+type fallbackLister struct {
+	ConfigMapLister
+	endpoints []string
+	fallbacks []ConfigMapLister
+}
+
+func (l *fallbackLister) List(namespace, selector string) (*ConfigMapList, error) {
+	list, err := l.ConfigMapLister.List(namespace, selector)
+	// a forbidden namespace is forbidden on every endpoint
+	if err == nil || err == ErrForbidden {
+		return list, err
+	}
+	for i, f := range l.fallbacks {
+		log.Printf("failed to list config maps in %q, falling back to %s: %v", namespace, l.endpoints[i], err)
+		if list, err = f.List(namespace, selector); err == nil {
+			return list, nil
+		}
+	}
+	return nil, err
+}
+
+func (l *fallbackLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	w, ok := l.ConfigMapLister.(watcher)
+	if !ok {
+		return errors.New("source does not support watching")
+	}
+	return w.watch(namespace, selector, done, fn)
+}
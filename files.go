@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stateFile in the output directory lists the files the aggregator manages,
+// so it can share the directory with other writers.
+const stateFile = ".configmap-aggregator-state"
+
+type fileState struct {
+	Files []string `json:"files"`
+	// what the files held when they were last written or compared, so
+	// unchanged files need not be read again
+	Hashes map[string]fileHash `json:"hashes,omitempty"`
+	// hashes were added or refreshed since the state file was read
+	stale bool
+}
+
+type fileHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+func hashValue(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:])
+}
+
+// matches reports whether the file described by info still holds the
+// hashed content.
+func (h fileHash) matches(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Size() == h.Size && info.ModTime().Equal(h.ModTime)
+}
+
+// pathPrefixAnnotation on a source places its keys in a subdirectory of the
+// output directory, using the key as the file name.
+const pathPrefixAnnotation = "configmap-aggregator/path-prefix"
+
+// filePath returns the path below the output directory for key of a source.
+// Keys that contain a path separator, or come from a source with a path
+// prefix, are used as is so they can land in nested directories.
+func filePath(cm *ConfigMap, key string) (string, bool) {
+	prefix := cm.Metadata.Annotations[pathPrefixAnnotation]
+	if prefix == "" && !strings.Contains(key, "/") {
+		return "", false
+	}
+	return path.Join(prefix, key), true
+}
+
+// validatePath checks that p is a relative path that stays within the output
+// directory and that each element is a valid key.
+func validatePath(p string) error {
+	if path.IsAbs(p) || path.Clean(p) != p {
+		return errors.New("must be a clean relative path")
+	}
+	if p == stateFile {
+		return errors.New("is reserved for the state file")
+	}
+	if p == changelogFile {
+		return errors.New("is reserved for the changelog")
+	}
+	for _, e := range strings.Split(p, "/") {
+		if e == ".." {
+			return errors.New("must not refer to a parent directory")
+		}
+		if err := validateKey(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readState returns the files listed in the state file.
+func (c *controller) readState() ([]string, error) {
+	state, err := readStateFile(c.outputDir)
+	if err != nil {
+		return nil, err
+	}
+	return state.Files, nil
+}
+
+func readStateFile(dir string) (*fileState, error) {
+	var state fileState
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return &state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrap(err, "failed to parse state file")
+	}
+	return &state, nil
+}
+
+func writeState(dir string, files []string, hashes map[string]fileHash) error {
+	state := &fileState{Files: files, Hashes: make(map[string]fileHash)}
+	for _, f := range files {
+		if h, ok := hashes[f]; ok {
+			state.Hashes[f] = h
+		}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, stateFile), data); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	return nil
+}
+
+// fileChanges compares the managed files with cm one at a time, rather than
+// reading them all into memory. In exact compare mode, files whose size and
+// modification time match the state file are compared by hash without
+// reading them. It returns the changes along with the existing files and
+// the hashes of those found unchanged.
+func (c *controller) fileChanges(cm *ConfigMap) (*fileState, *changeSet, error) {
+	state, err := readStateFile(c.outputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	exact := c.exactCompare()
+	existing := &fileState{Hashes: make(map[string]fileHash)}
+	changes := &changeSet{}
+	found := make(map[string]bool, len(state.Files))
+	for _, f := range state.Files {
+		name := filepath.Join(c.outputDir, filepath.FromSlash(f))
+		info, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to read %s", f)
+		}
+		found[f] = true
+		existing.Files = append(existing.Files, f)
+		v, ok := cm.Data[f]
+		if !ok {
+			changes.Removed = append(changes.Removed, f)
+			continue
+		}
+
+		var same bool
+		cached, hit := state.Hashes[f]
+		switch {
+		case exact && hit && cached.matches(info):
+			same = cached.Hash == hashValue(v)
+		case exact:
+			same, err = sameContent(name, v)
+		default:
+			var data []byte
+			if data, err = ioutil.ReadFile(name); err == nil {
+				same = c.valuesEqual(string(data), v)
+			}
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, errors.Wrapf(err, "failed to read %s", f)
+		}
+		if !same {
+			changes.Modified = append(changes.Modified, f)
+			continue
+		}
+		if exact {
+			h := fileHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hashValue(v)}
+			existing.Hashes[f] = h
+			if !hit || h.Hash != cached.Hash || !cached.matches(info) {
+				existing.stale = true
+			}
+		}
+	}
+	for k := range cm.Data {
+		if !found[k] {
+			changes.Added = append(changes.Added, k)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Modified)
+	sort.Strings(changes.Removed)
+	return existing, changes, nil
+}
+
+// sameContent reports whether the file name holds exactly v, reading it in
+// chunks.
+func sameContent(name, v string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != int64(len(v)) {
+		return false, nil
+	}
+	buf := make([]byte, 32*1024)
+	for off := 0; ; {
+		n, err := f.Read(buf)
+		if n > len(v)-off || string(buf[:n]) != v[off:off+n] {
+			return false, nil
+		}
+		off += n
+		if err == io.EOF {
+			return off == len(v), nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// readFiles returns the managed files in the output directory, keyed by
+// their slash separated path relative to it. Other files are ignored.
+func (c *controller) readFiles() (*ConfigMap, error) {
+	cm := newConfigMap("", "")
+	cm.Data = make(map[string]string)
+
+	files, err := c.readState()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(c.outputDir, filepath.FromSlash(f)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", f)
+		}
+		cm.Data[f] = string(data)
+	}
+	return cm, nil
+}
+
+// managedFile reports whether name is listed in the state file.
+func (c *controller) managedFile(name string) bool {
+	files, err := c.readState()
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unmanagedFiles returns the files in the output directory that are not
+// listed in the state file.
+func (c *controller) unmanagedFiles() ([]string, error) {
+	files, err := c.readState()
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]bool, len(files))
+	for _, f := range files {
+		managed[f] = true
+	}
+
+	var unmanaged []string
+	err = filepath.Walk(c.outputDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.outputDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel != stateFile && rel != changelogFile && !managed[rel] {
+			unmanaged = append(unmanaged, rel)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read %s", c.outputDir)
+	}
+	return unmanaged, nil
+}
+
+// claimOutputDir refuses to use an output directory holding files the
+// aggregator did not write, unless forceClean is set in which case they are
+// removed.
+func (c *controller) claimOutputDir() error {
+	unmanaged, err := c.unmanagedFiles()
+	if err != nil {
+		return err
+	}
+	if len(unmanaged) == 0 {
+		return nil
+	}
+	if !c.forceClean {
+		return errors.Errorf("output directory %s contains files not written by the aggregator (%s), use --force-clean to remove them", c.outputDir, strings.Join(unmanaged, ", "))
+	}
+	for _, f := range unmanaged {
+		c.logf("removing unmanaged file %s from %s", f, c.outputDir)
+		if err := removeFile(c.outputDir, filepath.Join(c.outputDir, filepath.FromSlash(f))); err != nil {
+			return errors.Wrapf(err, "failed to remove %s", f)
+		}
+	}
+	return nil
+}
+
+// writeFile replaces a file atomically so readers never see a partial write.
+func writeFile(name string, data []byte) error {
+	return writeFileFrom(name, bytes.NewReader(data))
+}
+
+// writeFileFrom is writeFile for data streamed from r.
+func writeFileFrom(name string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// removeFile removes a file and any directories left empty by it, up to
+// the directory dir.
+func removeFile(dir, name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := filepath.Clean(dir)
+	for dir := filepath.Dir(name); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			// not empty
+			break
+		}
+	}
+	return nil
+}
+
+// writeAll writes the files for keys of cm with at most writeConcurrency
+// writes in flight, which speeds up network filesystems, and records what
+// they hold in hashes. If writes fail, the error of the first failed key in
+// keys is returned.
+func (c *controller) writeAll(keys []string, cm *ConfigMap, hashes map[string]fileHash) error {
+	concurrency := c.writeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, concurrency)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, k := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, k string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			name := filepath.Join(c.outputDir, filepath.FromSlash(k))
+			// read from the aggregate in place, without a copy as bytes
+			if err := writeFileFrom(name, strings.NewReader(cm.Data[k])); err != nil {
+				errs[i] = errors.Wrapf(err, "failed to write %s", k)
+				return
+			}
+			if info, err := os.Stat(name); err == nil {
+				mu.Lock()
+				hashes[k] = fileHash{Size: info.Size(), ModTime: info.ModTime(), Hash: hashValue(cm.Data[k])}
+				mu.Unlock()
+			}
+			if ct := c.contentTypes[k]; ct != "" {
+				if err := setContentType(name, ct); err != nil {
+					c.logf("failed to set content type of %s: %v", k, err)
+				}
+			}
+		}(i, k)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFiles writes each key of cm to a file in the output directory and
+// removes managed files that are no longer in the aggregate. New files are
+// recorded in the state file before they are written, and removed files
+// after they are removed, so an interrupted sync never leaves files behind
+// that are not managed.
+func (c *controller) writeFiles(cm *ConfigMap) (*changeSet, error) {
+	state, changes, err := c.fileChanges(cm)
+	if err != nil {
+		return nil, err
+	}
+	if changes.empty() {
+		if state.stale {
+			if err := writeState(c.outputDir, state.Files, state.Hashes); err != nil {
+				return nil, err
+			}
+		}
+		return changes, nil
+	}
+	existing := newConfigMap("", "")
+	for _, f := range state.Files {
+		existing.Data[f] = ""
+	}
+	if err := c.checkRemoved(existing, cm); err != nil {
+		return nil, err
+	}
+
+	// a file may have appeared since the output directory was claimed
+	for _, k := range changes.Added {
+		_, err := os.Lstat(filepath.Join(c.outputDir, filepath.FromSlash(k)))
+		if err == nil && !c.forceClean {
+			return nil, errors.Errorf("refusing to overwrite unmanaged file %s", k)
+		}
+	}
+	if len(changes.Added) > 0 {
+		files := sortedKeys(existing.Data)
+		files = append(files, changes.Added...)
+		if err := writeState(c.outputDir, files, state.Hashes); err != nil {
+			return nil, err
+		}
+	}
+	written := append(append([]string{}, changes.Added...), changes.Modified...)
+	if err := c.writeAll(written, cm, state.Hashes); err != nil {
+		return nil, err
+	}
+	for _, k := range changes.Removed {
+		if err := removeFile(c.outputDir, filepath.Join(c.outputDir, filepath.FromSlash(k))); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove %s", k)
+		}
+	}
+	if err := writeState(c.outputDir, sortedKeys(cm.Data), state.Hashes); err != nil {
+		return nil, err
+	}
+	if err := c.appendChangelog(cm, changes); err != nil {
+		c.logf("%v", err)
+	}
+
+	c.logf("updated %d files in %s", len(changes.keys()), c.outputDir)
+	c.lastWrite = time.Now()
+	return changes, nil
+}
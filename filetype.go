@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// fileType maps files whose names match a glob pattern to an extension and
+// content type, and optionally renders them as templates. Patterns without
+// a / are matched against the base name of the file.
+type fileType struct {
+	pattern string
+	// replaces the extension of the file. nil keeps it, empty strips it.
+	ext         *string
+	contentType string
+	render      bool
+}
+
+// parseFileType parses a pattern followed by whitespace separated options:
+// ext=<extension> content-type=<type> render=true
+func parseFileType(spec string) (*fileType, error) {
+	parts := strings.Fields(spec)
+	if len(parts) == 0 {
+		return nil, errors.New("empty file type")
+	}
+	if _, err := path.Match(parts[0], ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid file pattern %q", parts[0])
+	}
+
+	ft := &fileType{pattern: parts[0]}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid file type option %q: expected <name>=<value>", opt)
+		}
+		switch kv[0] {
+		case "ext":
+			ext := kv[1]
+			if ext != "" && !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			ft.ext = &ext
+		case "content-type":
+			ft.contentType = kv[1]
+		case "render":
+			ft.render = kv[1] == "true"
+		default:
+			return nil, errors.Errorf("unknown file type option %q", kv[0])
+		}
+	}
+	return ft, nil
+}
+
+func (ft *fileType) match(name string) bool {
+	if !strings.Contains(ft.pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(ft.pattern, name)
+	return ok
+}
+
+func (ft *fileType) rename(name string) string {
+	if ft.ext == nil {
+		return name
+	}
+	return strings.TrimSuffix(name, path.Ext(name)) + *ft.ext
+}
+
+// renderData is passed to rendered files.
+type renderData struct {
+	Env  map[string]string
+	Data map[string]string
+}
+
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+}
+
+// mapFileTypes renames and renders the files of cm according to the first
+// file type matching each, and records their content types.
+func (c *controller) mapFileTypes(cm *ConfigMap) error {
+	c.contentTypes = make(map[string]string)
+	if len(c.fileTypes) == 0 {
+		return nil
+	}
+
+	rd := &renderData{Env: environ(), Data: cm.Data}
+	data := make(map[string]string, len(cm.Data))
+	for _, k := range sortedKeys(cm.Data) {
+		name, v := k, cm.Data[k]
+		for _, ft := range c.fileTypes {
+			if !ft.match(k) {
+				continue
+			}
+			if ft.render {
+				t, err := template.New(k).Option("missingkey=error").Parse(v)
+				if err == nil {
+					var buf bytes.Buffer
+					err = t.Execute(&buf, rd)
+					v = buf.String()
+				}
+				if err != nil {
+					if err := c.warn("skipping file %s: failed to render: %v", k, err); err != nil {
+						return err
+					}
+					name = ""
+					break
+				}
+			}
+			name = ft.rename(k)
+			if ft.contentType != "" {
+				c.contentTypes[name] = ft.contentType
+			}
+			break
+		}
+		if name == "" {
+			continue
+		}
+		if err := validatePath(name); err != nil {
+			if err := c.warn("skipping file %s renamed to %q: %v", k, name, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := data[name]; ok {
+			if err := c.warn("file %s renamed to %s conflicts with an existing file", k, name); err != nil {
+				return err
+			}
+			continue
+		}
+		data[name] = v
+	}
+	cm.Data = data
+	return nil
+}
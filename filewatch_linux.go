@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const fileWatchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+// watchOutputDir triggers a sync when a managed file in the output directory
+// is modified or removed by someone else, so it is rewritten right away.
+// Files are replaced by renaming a temporary file over them, which is not
+// reported, so writes by the aggregator itself do not trigger a sync.
+func (c *controller) watchOutputDir(done <-chan struct{}) {
+	if err := os.MkdirAll(c.outputDir, 0755); err != nil {
+		c.logf("failed to watch %s: %v", c.outputDir, err)
+		return
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		c.logf("failed to watch %s: %v", c.outputDir, err)
+		return
+	}
+	go func() {
+		<-done
+		syscall.Close(fd)
+	}()
+
+	// watch descriptors to directories relative to the output directory
+	dirs := make(map[int]string)
+	addDirs := func(root string) {
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			wd, err := syscall.InotifyAddWatch(fd, p, fileWatchMask)
+			if err != nil {
+				c.logf("failed to watch %s: %v", p, err)
+				return nil
+			}
+			rel, _ := filepath.Rel(c.outputDir, p)
+			dirs[wd] = filepath.ToSlash(rel)
+			return nil
+		})
+	}
+	addDirs(c.outputDir)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(fd, buf)
+		if err != nil {
+			select {
+			case <-done:
+			default:
+				c.logf("failed to watch %s: %v", c.outputDir, err)
+			}
+			return
+		}
+
+		changed := make(map[string]bool)
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(e.Len)]
+			offset += syscall.SizeofInotifyEvent + int(e.Len)
+
+			dir, ok := dirs[int(e.Wd)]
+			if !ok {
+				continue
+			}
+			if e.Mask&syscall.IN_IGNORED != 0 {
+				delete(dirs, int(e.Wd))
+				continue
+			}
+			name := path.Join(dir, string(bytes.TrimRight(nameBytes, "\x00")))
+			if e.Mask&syscall.IN_CREATE != 0 {
+				if e.Mask&syscall.IN_ISDIR != 0 {
+					addDirs(filepath.Join(c.outputDir, filepath.FromSlash(name)))
+				}
+				continue
+			}
+			if !changed[name] && c.managedFile(name) {
+				c.logf("%s was changed outside of the aggregator, rewriting it", name)
+				changed[name] = true
+			}
+		}
+		if len(changed) > 0 {
+			c.notify()
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// watchOutputDir is only supported on linux. Elsewhere managed files that are
+// changed out of band are rewritten on the next sync.
+func (c *controller) watchOutputDir(done <-chan struct{}) {
+	c.logf("watching %s for changes is not supported on this platform", c.outputDir)
+}
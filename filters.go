@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ownerFilter matches sources with an owner reference of a kind and a name
+// matching a glob pattern.
+type ownerFilter struct {
+	kind    string
+	pattern string
+}
+
+// parseOwnerFilter parses kind or kind/name-pattern, such as Deployment/prometheus-*.
+func parseOwnerFilter(s string) (*ownerFilter, error) {
+	parts := strings.SplitN(s, "/", 2)
+	f := &ownerFilter{kind: parts[0], pattern: "*"}
+	if len(parts) == 2 {
+		f.pattern = parts[1]
+	}
+	if f.kind == "" || f.pattern == "" {
+		return nil, errors.Errorf("invalid owner %q: expected <kind>[/<name-pattern>]", s)
+	}
+	if _, err := path.Match(f.pattern, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid owner %q", s)
+	}
+	return f, nil
+}
+
+func (f *ownerFilter) match(ref OwnerReference) bool {
+	if !strings.EqualFold(f.kind, ref.Kind) {
+		return false
+	}
+	ok, _ := path.Match(f.pattern, ref.Name)
+	return ok
+}
+
+// ownedBy reports whether cm has an owner matching any of the owner filters,
+// or there are none.
+func (c *controller) ownedBy(cm *ConfigMap) bool {
+	if len(c.owners) == 0 {
+		return true
+	}
+	for _, ref := range cm.Metadata.OwnerReferences {
+		for _, f := range c.owners {
+			if f.match(ref) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inTimeRange reports whether cm was created within the creation time
+// filters and is at least minAge old. A single sync is scheduled for when the
+// first source that is too young becomes old enough, and that sync schedules
+// the next.
+func (c *controller) inTimeRange(cm *ConfigMap) bool {
+	created := cm.Metadata.CreationTimestamp
+	if created == nil {
+		return c.minAge == 0 && c.createdAfter.IsZero() && c.createdBefore.IsZero()
+	}
+	if !c.createdAfter.IsZero() && created.Before(c.createdAfter) {
+		return false
+	}
+	if !c.createdBefore.IsZero() && !created.Before(c.createdBefore) {
+		return false
+	}
+	mature := created.Add(c.minAge)
+	if now := time.Now(); mature.After(now) {
+		if !c.matureRecheck.After(now) || mature.Before(c.matureRecheck) {
+			wait := mature.Sub(now)
+			c.logf("skipping config map %s/%s for another %v: younger than %v", cm.Metadata.Namespace, cm.Metadata.Name, wait.Round(time.Second), c.minAge)
+			c.matureRecheck = mature
+			time.AfterFunc(wait, c.notify)
+		}
+		return false
+	}
+	return true
+}
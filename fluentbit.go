@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// fluentBitSections are the sections of a fluent-bit configuration, in the
+// order they are written, so every input is declared before the filters
+// and outputs that match it.
+var fluentBitSections = []string{"SERVICE", "PARSER", "MULTILINE_PARSER", "CUSTOM", "INPUT", "FILTER", "OUTPUT"}
+
+// fluentBitFragment splits a fragment into its directives, such as @SET and
+// @INCLUDE, and its sections, each rendered with a consistent indent, keyed
+// by section name.
+func fluentBitFragment(fragment string) ([]string, map[string][]string, error) {
+	known := make(map[string]bool, len(fluentBitSections))
+	for _, s := range fluentBitSections {
+		known[s] = true
+	}
+
+	var directives []string
+	sections := make(map[string][]string)
+	var buf *bytes.Buffer
+	var current string
+	flush := func() {
+		if buf != nil {
+			sections[current] = append(sections[current], buf.String())
+		}
+	}
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			flush()
+			current = strings.ToUpper(strings.Trim(line, "[]"))
+			if !known[current] {
+				return nil, nil, errors.Errorf("unknown section %s", line)
+			}
+			buf = bytes.NewBufferString("[" + current + "]\n")
+		case line == "":
+		case buf == nil:
+			if !strings.HasPrefix(line, "@") && !strings.HasPrefix(line, "#") {
+				return nil, nil, errors.Errorf("%q is outside of a section", line)
+			}
+			directives = append(directives, line)
+		default:
+			if !strings.HasPrefix(line, "#") && len(strings.Fields(line)) < 2 {
+				return nil, nil, errors.Errorf("expected <key> <value>, got %q", line)
+			}
+			buf.WriteString("    " + line + "\n")
+		}
+	}
+	flush()
+	return directives, sections, nil
+}
+
+// mergeFluentBit combines fluent-bit configuration fragments into a single
+// file, grouping sections by kind and keeping the order of fragments within
+// each kind. Invalid fragments are skipped.
+func (c *controller) mergeFluentBit(keys []string, data map[string]string) (string, error) {
+	var directives []string
+	sections := make(map[string][]string)
+	for _, k := range keys {
+		d, s, err := fluentBitFragment(data[k])
+		if err != nil {
+			if err := c.warn("skipping fluent-bit fragment %s: %v", k, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+		directives = append(directives, d...)
+		for name, v := range s {
+			sections[name] = append(sections[name], v...)
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, d := range directives {
+		buf.WriteString(d + "\n")
+	}
+	for _, name := range fluentBitSections {
+		for _, s := range sections[name] {
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString(s)
+		}
+	}
+	return buf.String(), nil
+}
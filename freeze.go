@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// frozenKey in the freeze config map freezes changes while it is "true".
+const frozenKey = "frozen"
+
+// freezeWindow freezes changes for a duration from every time a cron
+// schedule matches.
+type freezeWindow struct {
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+// parseFreezeWindow parses a cron schedule followed by a duration, such as
+// "0 18 * * 5 63h" for weekends.
+func parseFreezeWindow(spec string) (*freezeWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return nil, errors.Errorf("invalid freeze window %q: expected <schedule> <duration>", spec)
+	}
+	d, err := time.ParseDuration(fields[len(fields)-1])
+	if err != nil || d <= 0 {
+		return nil, errors.Errorf("invalid freeze window %q: invalid duration %q", spec, fields[len(fields)-1])
+	}
+	s, err := parseCronSchedule(strings.Join(fields[:len(fields)-1], " "))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid freeze window %q", spec)
+	}
+	return &freezeWindow{schedule: s, duration: d}, nil
+}
+
+// end returns when the window covering now ends, if any.
+func (w *freezeWindow) end(now time.Time) (time.Time, bool) {
+	var end time.Time
+	for t := w.schedule.next(now.Add(-w.duration)); !t.After(now); t = w.schedule.next(t) {
+		if e := t.Add(w.duration); e.After(end) {
+			end = e
+		}
+	}
+	return end, end.After(now)
+}
+
+// frozenUntil reports whether changes are frozen, and until when. The zero
+// time means until the freeze config map or a pause marker lifts the freeze.
+func (c *controller) frozenUntil(now time.Time) (time.Time, bool, error) {
+	var until time.Time
+	frozen := false
+	for _, w := range c.freezeWindows {
+		if end, ok := w.end(now); ok {
+			frozen = true
+			if end.After(until) {
+				until = end
+			}
+		}
+	}
+	if c.freezeConfigMap != "" {
+		parts := strings.SplitN(c.freezeConfigMap, "/", 2)
+		cm, err := c.client.getConfigMap(parts[0], parts[1])
+		if err != nil && err != ErrNotExist {
+			return time.Time{}, false, errors.Wrapf(err, "failed to get freeze config map %s", c.freezeConfigMap)
+		}
+		if cm != nil && strings.TrimSpace(cm.Data[frozenKey]) == "true" {
+			c.recheckFreeze(now)
+			return time.Time{}, true, nil
+		}
+	}
+	m, err := c.paused()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if m != nil {
+		c.recheckFreeze(now)
+		return time.Time{}, true, nil
+	}
+	return until, frozen, nil
+}
+
+// recheckFreeze schedules a sync shortly, once, as neither the freeze config
+// map nor a sync in progress has a known end.
+func (c *controller) recheckFreeze(now time.Time) {
+	if !now.Before(c.freezeRecheck) {
+		c.freezeRecheck = now.Add(pauseRecheckInterval)
+		time.AfterFunc(pauseRecheckInterval, c.notify)
+	}
+}
+
+// frozen reports whether cm must not be applied because of a change freeze.
+// Changes held back are logged and recorded, and a sync is scheduled for when
+// a freeze window ends.
+func (c *controller) frozen(cm *ConfigMap) (bool, error) {
+	now := time.Now()
+	until, frozen, err := c.frozenUntil(now)
+	if err != nil || !frozen {
+		frozenChanges.set(0, "rule", c.name)
+		return false, err
+	}
+
+	changes, err := c.pendingChanges(cm)
+	if err != nil {
+		return false, err
+	}
+	frozenChanges.set(float64(len(changes.keys())), "rule", c.name)
+	if changes.empty() {
+		return true, nil
+	}
+
+	if !until.IsZero() && !until.Equal(c.freezeEnd) {
+		c.freezeEnd = until
+		time.AfterFunc(until.Sub(now), c.notify)
+	}
+	if hash := hashConfigMap(cm); hash != c.frozenHash {
+		c.frozenHash = hash
+		lifted := "the freeze is lifted"
+		if !until.IsZero() {
+			lifted = until.Format(time.RFC3339)
+		}
+		c.logf("holding back changes to %s until %s", strings.Join(changes.keys(), ", "), lifted)
+		c.recordEvent("Normal", "ChangesFrozen", "holding back changes to %s until %s", strings.Join(changes.keys(), ", "), lifted)
+	}
+	return true, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// instanceLabel identifies the aggregator deployment that owns a target
+	instanceLabel = "configmap-aggregator/instance"
+	// ruleLabel identifies the rule that wrote a target by a hash of its
+	// selectors, namespaces, and target
+	ruleLabel = "configmap-aggregator/rule"
+	// ruleNameAnnotation names the rule that recorded an event
+	ruleNameAnnotation = "configmap-aggregator/rule-name"
+)
+
+// checkOwner refuses to write a target labeled with another instance, so
+// aggregator instances sharing a cluster never fight over a target.
+func (c *controller) checkOwner(labels map[string]string) error {
+	owner, ok := labels[instanceLabel]
+	if !ok || owner == c.instance {
+		return nil
+	}
+	return errors.Errorf("target %s/%s belongs to instance %q", c.targetNamespace, c.targetName, owner)
+}
+
+// collectGarbage deletes config maps labeled with the instance that are no
+// longer the target of any rule, such as after a target was renamed, a rule
+// was removed, or the number of shards went down.
+func collectGarbage(client *k8sClient, instance string, sh *shard, controllers []*controller) error {
+	list, err := client.getConfigMaps("", instanceLabel+"="+instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to list managed targets")
+	}
+
+	current := make(map[string]bool)
+	for _, c := range controllers {
+		if c.targetName != "" && c.targetResource == nil {
+			current[c.targetNamespace+"/"+c.targetName] = true
+		}
+		if c.stagingName != "" {
+			current[c.targetNamespace+"/"+c.stagingName] = true
+		}
+	}
+
+	for _, cm := range list.Items {
+		if cm.Metadata.Annotations["configmap-aggregator"] != "target" {
+			continue
+		}
+		name := cm.Metadata.Namespace + "/" + cm.Metadata.Name
+		if current[name] || !sh.collects(cm.Metadata.Labels[shardLabel]) {
+			continue
+		}
+		log.Printf("deleting stale target %s of rule %s", name, cm.Metadata.Labels[ruleLabel])
+		if err := client.deleteConfigMap(cm.Metadata.Namespace, cm.Metadata.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownTarget reports whether cm is written by this aggregator, either by any
+// of its rules or, when an instance is set, by an earlier run, so broad
+// selectors do not feed targets back into the aggregate.
+func (c *controller) ownTarget(cm *ConfigMap) bool {
+	// config maps of other clusters are never our targets
+	if cm.Metadata.Annotations[sourceAnnotation] != "" {
+		return false
+	}
+	name := cm.Metadata.Namespace + "/" + cm.Metadata.Name
+	if name == c.targetNamespace+"/"+c.targetName || c.targets[name] {
+		return true
+	}
+	return c.instance != "" &&
+		cm.Metadata.Labels[instanceLabel] == c.instance &&
+		cm.Metadata.Annotations["configmap-aggregator"] == "target"
+}
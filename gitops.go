@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const applyPatchType = "application/apply-patch+yaml"
+
+// gitopsAnnotations tell GitOps controllers that the target is managed
+// outside of Git: Argo CD neither reports it as out of sync nor prunes it,
+// and Flux creates it if it is declared but never overwrites it.
+var gitopsAnnotations = map[string]string{
+	"argocd.argoproj.io/compare-options": "IgnoreExtraneous",
+	"argocd.argoproj.io/sync-options":    "Prune=false",
+	"kustomize.toolkit.fluxcd.io/ssa":    "IfNotPresent",
+}
+
+// applyConfigMap writes the config map with server-side apply, forcing
+// conflicts, so the aggregator owns exactly the fields it sets.
+func (k *k8sClient) applyConfigMap(c *ConfigMap) error {
+	obj := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":        c.Metadata.Name,
+			"namespace":   c.Metadata.Namespace,
+			"labels":      c.Metadata.Labels,
+			"annotations": c.Metadata.Annotations,
+		},
+		"data": c.Data,
+	}
+	if len(c.BinaryData) > 0 {
+		obj["binaryData"] = c.BinaryData
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding configmap %s: %v", c.Metadata.Name, err)
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps/%s?force=true", k.endpoint, c.Metadata.Namespace, c.Metadata.Name)
+	request, err := http.NewRequest(http.MethodPatch, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error applying configmap %s: %v", c.Metadata.Name, err)
+	}
+	request.Header.Set("Content-Type", applyPatchType)
+
+	resp, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error applying configmap %s: %v", c.Metadata.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return statusError(resp, "error applying configmap "+c.Metadata.Name)
+	}
+	return nil
+}
+
+// applyTarget writes the target with server-side apply and the GitOps
+// annotations. Only the aggregate's own labels and annotations are sent, so
+// fields set by a GitOps controller stay owned by it.
+func (c *controller) applyTarget(cm *ConfigMap) (*changeSet, error) {
+	existing, err := c.client.getConfigMap(c.targetNamespace, c.targetName)
+	switch {
+	case err == ErrNotExist:
+		existing = newConfigMap(c.targetNamespace, c.targetName)
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to get config map %s/%s", c.targetNamespace, c.targetName)
+	default:
+		if err := c.checkOwner(existing.Metadata.Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	annotated := true
+	for k, v := range gitopsAnnotations {
+		cm.Metadata.Annotations[k] = v
+		if existing.Metadata.Annotations[k] != v {
+			annotated = false
+		}
+	}
+	changes := c.diff(existing, cm)
+	if changes.empty() && annotated {
+		return changes, nil
+	}
+	if err := c.checkRemoved(existing, cm); err != nil {
+		return nil, err
+	}
+
+	if err := c.client.applyConfigMap(cm); err != nil {
+		return nil, err
+	}
+	c.logf("applied %d keys to %s/%s", len(cm.Data)+len(cm.BinaryData), c.targetNamespace, c.targetName)
+	c.lastWrite = time.Now()
+	return changes, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// syncStatus tracks the progress of the initial sync of a rule.
+type syncStatus struct {
+	mu              sync.Mutex
+	ready           bool
+	namespacesDone  int
+	namespacesTotal int
+}
+
+func (s *syncStatus) setReady() {
+	s.mu.Lock()
+	s.ready = true
+	s.mu.Unlock()
+}
+
+func (s *syncStatus) isReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// progress records how many namespaces have been listed. It returns true
+// while the initial sync is still running.
+func (s *syncStatus) progress(done, total int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.namespacesDone = done
+	s.namespacesTotal = total
+	return !s.ready
+}
+
+func (s *syncStatus) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return "ready"
+	}
+	return fmt.Sprintf("initial sync in progress: %d/%d namespaces", s.namespacesDone, s.namespacesTotal)
+}
+
+func serveHTTP(address string, controllers []*controller) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	// ready once every rule has completed its initial sync
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready := true
+		for _, c := range controllers {
+			if !c.status.isReady() {
+				ready = false
+			}
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, c := range controllers {
+			fmt.Fprintf(w, "%s: %s\n", c.name, c.status)
+		}
+	})
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Fatalf("failed to serve http: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import [directory] [namespace]",
+	Short: "create or update a labeled source config map for each subdirectory",
+	Run:   runImport,
+}
+
+var importLabelSpecs []string
+
+// readSourceDir returns a config map with a key for each regular file in
+// dir. Files that are not valid UTF-8 go to binaryData.
+func readSourceDir(namespace, name, dir string) (*ConfigMap, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", dir)
+	}
+	cm := newConfigMap(namespace, name)
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if err := validateKey(f.Name()); err != nil {
+			return nil, errors.Wrapf(err, "invalid key %s in %s", f.Name(), dir)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", f.Name())
+		}
+		if utf8.Valid(data) {
+			cm.Data[f.Name()] = string(data)
+			continue
+		}
+		if cm.BinaryData == nil {
+			cm.BinaryData = make(map[string][]byte)
+		}
+		cm.BinaryData[f.Name()] = data
+	}
+	return cm, nil
+}
+
+// importSource creates the config map, or updates it if it already carries
+// the labels. Config maps created by something else are left alone.
+func importSource(client *k8sClient, cm *ConfigMap, labels map[string]string) error {
+	for k, v := range labels {
+		cm.Metadata.Labels[k] = v
+	}
+	existing, err := client.getConfigMap(cm.Metadata.Namespace, cm.Metadata.Name)
+	if err == ErrNotExist {
+		if dryRun {
+			log.Printf("dry run: would create %s/%s with %d keys", cm.Metadata.Namespace, cm.Metadata.Name, len(cm.Data)+len(cm.BinaryData))
+			return nil
+		}
+		if err := client.createConfigMap(cm); err != nil {
+			return err
+		}
+		log.Printf("created %s/%s with %d keys", cm.Metadata.Namespace, cm.Metadata.Name, len(cm.Data)+len(cm.BinaryData))
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s/%s", cm.Metadata.Namespace, cm.Metadata.Name)
+	}
+
+	for k, v := range labels {
+		if existing.Metadata.Labels[k] != v {
+			return errors.Errorf("%s/%s exists without label %s=%s", cm.Metadata.Namespace, cm.Metadata.Name, k, v)
+		}
+	}
+	existing.Data = cm.Data
+	existing.BinaryData = cm.BinaryData
+	if dryRun {
+		log.Printf("dry run: would update %s/%s with %d keys", cm.Metadata.Namespace, cm.Metadata.Name, len(cm.Data)+len(cm.BinaryData))
+		return nil
+	}
+	if err := client.updateConfigMap(existing); err != nil {
+		return err
+	}
+	log.Printf("updated %s/%s with %d keys", cm.Metadata.Namespace, cm.Metadata.Name, len(cm.Data)+len(cm.BinaryData))
+	return nil
+}
+
+// runImport seeds source config maps from a directory tree, one per
+// subdirectory named after it, so existing file based configuration can be
+// aggregated.
+func runImport(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatal("directory and namespace are required")
+	}
+	if len(importLabelSpecs) == 0 {
+		log.Fatal("at least one label is required so the sources can be selected")
+	}
+	labels, err := parseLabels("label", importLabelSpecs, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirs, err := ioutil.ReadDir(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name() < dirs[j].Name() })
+
+	client, err := newAPIClient(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var errs syncErrors
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		name := d.Name()
+		if len(name) > 253 || !labelPrefix.MatchString(name) {
+			errs.add(errors.Errorf("%s is not a valid config map name", name))
+			continue
+		}
+		cm, err := readSourceDir(args[1], name, filepath.Join(args[0], name))
+		if err != nil {
+			errs.add(err)
+			continue
+		}
+		errs.add(importSource(client, cm, labels))
+	}
+	if err := errs.err(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// referencePattern matches ${key} references to other aggregated keys, and
+// $${key}, which escapes one.
+var referencePattern = regexp.MustCompile(`\$?\$\{([-._/a-zA-Z0-9]+)\}`)
+
+type interpolator struct {
+	data map[string]string
+	// resolve references to aggregated keys
+	keys bool
+	// environment variables that may be referenced
+	env []string
+	// resolved values
+	out map[string]string
+	// keys that cannot be resolved
+	failed   map[string]bool
+	visiting map[string]bool
+}
+
+// resolve returns the value of key with its references replaced. path is the
+// chain of keys that led to key, to report cycles.
+func (in *interpolator) resolve(key string, path []string) (string, error) {
+	if v, ok := in.out[key]; ok {
+		return v, nil
+	}
+	if in.failed[key] {
+		return "", errors.Errorf("%s cannot be interpolated", key)
+	}
+	path = append(path, key)
+	if in.visiting[key] {
+		return "", errors.Errorf("reference cycle %s", strings.Join(path, " -> "))
+	}
+	in.visiting[key] = true
+	defer delete(in.visiting, key)
+
+	var err error
+	v := referencePattern.ReplaceAllStringFunc(in.data[key], func(m string) string {
+		if err != nil {
+			return m
+		}
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+		ref := m[2 : len(m)-1]
+		if _, ok := in.data[ref]; !ok || !in.keys {
+			if matchAny(in.env, ref) {
+				if v, ok := os.LookupEnv(ref); ok {
+					return v
+				}
+			} else if !in.keys {
+				// only the environment is substituted
+				return m
+			}
+			err = errors.Errorf("unresolved reference %s", m)
+			return m
+		}
+		var r string
+		if r, err = in.resolve(ref, path); err != nil {
+			return m
+		}
+		// a trailing newline is part of the file, not the value
+		return strings.TrimSuffix(r, "\n")
+	})
+	if err != nil {
+		return "", err
+	}
+	in.out[key] = v
+	return v, nil
+}
+
+// interpolate replaces ${key} references in values with the value of the
+// aggregated key, if enabled, or of an allowed environment variable. Values
+// with unresolved references or reference cycles are left as they are.
+func (c *controller) interpolate(data map[string]string) (map[string]string, error) {
+	in := &interpolator{
+		data:     data,
+		keys:     c.interpolation,
+		env:      c.substituteEnv,
+		out:      make(map[string]string, len(data)),
+		failed:   make(map[string]bool),
+		visiting: make(map[string]bool),
+	}
+	for _, k := range sortedKeys(data) {
+		if _, err := in.resolve(k, nil); err != nil {
+			if err := c.warn("not interpolating %s: %v", k, err); err != nil {
+				return nil, err
+			}
+			in.failed[k] = true
+		}
+	}
+	for k := range in.failed {
+		in.out[k] = data[k]
+	}
+	return in.out, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// defaultKeyTemplate names aggregated keys after the source and its key.
+const defaultKeyTemplate = "{{.Namespace}}_{{.ConfigMap}}_{{.Key}}"
+
+// keyTemplatePresets are named key templates that may be given in place of
+// a template.
+var keyTemplatePresets = map[string]string{
+	// conf.d style includes, loaded in priority order
+	"include-dir": `{{.Priority}}-{{.Namespace}}-{{.ConfigMap}}-{{.Key | trimSuffix ".conf"}}.conf`,
+	// one dashboard file per key, for Grafana file provisioning
+	"grafana": `{{.Namespace}}-{{.ConfigMap}}-{{.Key | trimSuffix ".json"}}.json`,
+}
+
+// priorityAnnotation on a source orders its keys in include-dir style names.
+const priorityAnnotation = "configmap-aggregator/priority"
+
+const defaultPriority = 50
+
+var keyTemplateFuncs = template.FuncMap{
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+}
+
+// sourceModeAnnotation on a source overrides --source-mode for it.
+const sourceModeAnnotation = "configmap-aggregator/source-mode"
+
+const (
+	// each key of a source is a key of the aggregate
+	sourceModeKeys = "keys"
+	// the data of a source is a single JSON document in the aggregate
+	sourceModeJSON = "json"
+)
+
+func validateSourceMode(mode string) error {
+	switch mode {
+	case sourceModeKeys, sourceModeJSON:
+		return nil
+	}
+	return errors.Errorf("invalid source mode %q", mode)
+}
+
+// keyNameData is passed to key templates.
+type keyNameData struct {
+	Namespace string
+	ConfigMap string
+	Key       string
+	// two digit priority of the source, 50 unless annotated
+	Priority string
+	// name of the source endpoint, empty for the primary endpoint
+	Source string
+}
+
+func parseKeyTemplate(s string) (*template.Template, error) {
+	if p, ok := keyTemplatePresets[s]; ok {
+		s = p
+	}
+	t, err := template.New("key").Funcs(keyTemplateFuncs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key template %q", s)
+	}
+	return t, nil
+}
+
+// keyName returns the name of key of a source in the aggregate. In file
+// mode, this is the path of the file below the output directory.
+func (c *controller) keyName(cm *ConfigMap, key string) (string, error) {
+	priority, err := c.priority(cm)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = c.keyTemplate.Execute(&buf, &keyNameData{
+		Namespace: cm.Metadata.Namespace,
+		ConfigMap: cm.Metadata.Name,
+		Key:       key,
+		Priority:  fmt.Sprintf("%02d", priority),
+		Source:    cm.Metadata.Annotations[sourceAnnotation],
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to execute key template")
+	}
+	return buf.String(), nil
+}
+
+// priority returns the priority annotated on cm, from 0 to 99.
+func (c *controller) priority(cm *ConfigMap) (int, error) {
+	v, ok := cm.Metadata.Annotations[priorityAnnotation]
+	if !ok {
+		return defaultPriority, nil
+	}
+	p, err := strconv.Atoi(v)
+	if err != nil || p < 0 || p > 99 {
+		if err := c.warn("ignoring priority %q of %s/%s: must be 0 to 99", v, cm.Metadata.Namespace, cm.Metadata.Name); err != nil {
+			return 0, err
+		}
+		return defaultPriority, nil
+	}
+	return p, nil
+}
+
+// sourceEntry is a key and value a source contributes to the aggregate.
+type sourceEntry struct {
+	name  string
+	value string
+	// key of the source, or empty if the entry holds all of its data
+	key string
+}
+
+// sourceEntries returns the entries of a source, with canonical values, in
+// the order they are added to the aggregate.
+func (c *controller) sourceEntries(cm *ConfigMap) ([]sourceEntry, error) {
+	mode := c.sourceMode
+	if m, ok := cm.Metadata.Annotations[sourceModeAnnotation]; ok {
+		if err := validateSourceMode(m); err != nil {
+			if err := c.warn("ignoring source mode of %s/%s: %v", cm.Metadata.Namespace, cm.Metadata.Name, err); err != nil {
+				return nil, err
+			}
+		} else {
+			mode = m
+		}
+	}
+
+	if mode == sourceModeJSON {
+		doc := make(map[string]string, len(cm.Data))
+		for k, v := range cm.Data {
+			doc[k] = c.canonicalize(v)
+		}
+		b, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode %s/%s", cm.Metadata.Namespace, cm.Metadata.Name)
+		}
+		name := fmt.Sprintf("%s_%s.json", cm.Metadata.Namespace, cm.Metadata.Name)
+		if c.outputDir != "" {
+			if p, ok := filePath(cm, name); ok {
+				name = p
+			}
+		}
+		return []sourceEntry{{name: name, value: string(b) + "\n"}}, nil
+	}
+
+	entries := make([]sourceEntry, 0, len(cm.Data))
+	for _, k := range sortedKeys(cm.Data) {
+		name, err := c.keyName(cm, k)
+		if err != nil {
+			return nil, err
+		}
+		if c.outputDir != "" {
+			if p, ok := filePath(cm, k); ok {
+				name = p
+			}
+		}
+		entries = append(entries, sourceEntry{name: name, value: c.canonicalize(cm.Data[k]), key: k})
+	}
+	return entries, nil
+}
+
+// nestedDocument holds the aggregate as namespace, then config map, then key.
+type nestedDocument map[string]map[string]map[string]string
+
+// add records an entry of cm that was added to the aggregate.
+func (d nestedDocument) add(c *controller, cm *ConfigMap, e sourceEntry) {
+	ns := d[cm.Metadata.Namespace]
+	if ns == nil {
+		ns = make(map[string]map[string]string)
+		d[cm.Metadata.Namespace] = ns
+	}
+	data := ns[cm.Metadata.Name]
+	if data == nil {
+		data = make(map[string]string)
+		ns[cm.Metadata.Name] = data
+	}
+	if e.key != "" {
+		data[e.key] = e.value
+		return
+	}
+	for k, v := range cm.Data {
+		data[k] = c.canonicalize(v)
+	}
+}
+
+// validKey matches the keys the API server accepts in a config map.
+var validKey = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+func validateKey(key string) error {
+	if len(key) > 253 {
+		return errors.New("must be no more than 253 characters")
+	}
+	if !validKey.MatchString(key) {
+		return errors.New("must consist of alphanumeric characters, '-', '_' or '.'")
+	}
+	return nil
+}
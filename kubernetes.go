@@ -19,14 +19,44 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-var ErrNotExist = errors.New("object does not exist")
+var (
+	ErrNotExist  = errors.New("object does not exist")
+	ErrForbidden = errors.New("access forbidden")
+	// the object was modified since it was read
+	ErrConflict = errors.New("object was modified")
+	// the object exceeds the size limit of the API server
+	ErrTooLarge = errors.New("object is too large")
+	// the resource version to watch from is no longer available
+	errWatchGone = errors.New("resource version is too old to watch from")
+)
+
+// statusError returns the error for an unexpected response to a write,
+// wrapping ErrConflict or ErrTooLarge so callers can tell them apart.
+func statusError(resp *http.Response, msg string) error {
+	switch resp.StatusCode {
+	case 409:
+		return errors.Wrap(ErrConflict, msg)
+	case 413:
+		return errors.Wrap(ErrTooLarge, msg)
+	case 422:
+		// validation reports data over the config map limit as too long
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if bytes.Contains(body, []byte("Too long")) {
+			return errors.Wrap(ErrTooLarge, msg)
+		}
+	}
+	return fmt.Errorf("%s; got HTTP %v status code", msg, resp.StatusCode)
+}
 
 type ConfigMapList struct {
 	Items []ConfigMap `json:"items"`
@@ -35,21 +65,139 @@ type ConfigMapList struct {
 type ConfigMap struct {
 	ApiVersion string            `json:"apiVersion"`
 	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData,omitempty"`
 	Kind       string            `json:"kind"`
 	Metadata   Metadata          `json:"metadata"`
 }
 
 type Metadata struct {
 	Name            string            `json:"name"`
+	GenerateName    string            `json:"generateName,omitempty"`
 	Namespace       string            `json:"namespace"`
 	Labels          map[string]string `json:"labels"`
 	Annotations     map[string]string `json:"annotations"`
 	ResourceVersion string            `json:"resourceVersion"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+	// not set on objects being created
+	CreationTimestamp *time.Time `json:"creationTimestamp,omitempty"`
+}
+
+type OwnerReference struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+}
+
+type WatchEvent struct {
+	Type   string    `json:"type"`
+	Object ConfigMap `json:"object"`
+}
+
+type ObjectReference struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+}
+
+type EventSource struct {
+	Component string `json:"component"`
+}
+
+type Event struct {
+	ApiVersion     string          `json:"apiVersion"`
+	Kind           string          `json:"kind"`
+	Metadata       Metadata        `json:"metadata"`
+	InvolvedObject ObjectReference `json:"involvedObject"`
+	Reason         string          `json:"reason"`
+	Message        string          `json:"message"`
+	Type           string          `json:"type"`
+	Source         EventSource     `json:"source"`
+	Count          int             `json:"count"`
+	FirstTimestamp time.Time       `json:"firstTimestamp"`
+	LastTimestamp  time.Time       `json:"lastTimestamp"`
 }
 
 type k8sClient struct {
 	endpoint string
 	client   *http.Client
+
+	mu sync.Mutex
+	// resource version each source watch got to, by list url
+	watchVersions map[string]string
+}
+
+// fieldManager identifies the aggregator as the manager of the fields it
+// writes.
+const fieldManager = "configmap-aggregator"
+
+// userAgentSuffix is appended to the user agent, so cluster admins can tell
+// instances apart, for example to give them their own flow schema.
+var userAgentSuffix string
+
+// identifyingTransport sets the user agent of every request and the field
+// manager of every write, and authenticates requests if credentials are
+// configured.
+type identifyingTransport struct {
+	next        http.RoundTripper
+	credentials *credentials
+}
+
+func (t *identifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a round tripper must not modify the request it was given
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	ua := "configmap-aggregator/" + version
+	if userAgentSuffix != "" {
+		ua += " " + userAgentSuffix
+	}
+	r.Header.Set("User-Agent", ua)
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		u := *r.URL
+		q := u.Query()
+		if q.Get("fieldManager") == "" {
+			q.Set("fieldManager", fieldManager)
+			u.RawQuery = q.Encode()
+		}
+		r.URL = &u
+	}
+	if t.credentials == nil {
+		return t.next.RoundTrip(r)
+	}
+
+	token, err := t.credentials.bearer()
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.next.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// the token was rotated or revoked, so refresh it and retry requests
+	// that can be sent again
+	t.credentials.invalidate()
+	if r.Body != nil && r.GetBody == nil {
+		return resp, nil
+	}
+	token, err = t.credentials.bearer()
+	if err != nil {
+		return resp, nil
+	}
+	if r.GetBody != nil {
+		if r.Body, err = r.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(r)
 }
 
 func newk8sClient(endpoint string) *k8sClient {
@@ -58,36 +206,44 @@ func newk8sClient(endpoint string) *k8sClient {
 	}
 	return &k8sClient{
 		endpoint: endpoint,
-		client:   &http.Client{},
+		client:   &http.Client{Transport: &identifyingTransport{next: http.DefaultTransport}},
 	}
 }
 
-func (k *k8sClient) getConfigMaps(namespace, selector string) (*ConfigMapList, error) {
+func (k *k8sClient) configMapsURL(namespace string, query url.Values) string {
 	path := "/api/v1/configmaps"
 	if namespace != "" {
 		path = "/api/v1/namespaces/" + namespace + "/configmaps"
 	}
+	if len(query) > 0 {
+		path = path + "?" + query.Encode()
+	}
+	return k.endpoint + path
+}
+
+func (k *k8sClient) getConfigMaps(namespace, selector string) (*ConfigMapList, error) {
+	query := url.Values{}
 	if selector != "" {
-		path = path + "?labelSelector=" + selector
+		query.Set("labelSelector", selector)
 	}
 
-	resp, err := k.client.Get(k.endpoint + path)
+	resp, err := k.client.Get(k.configMapsURL(namespace, query))
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == 403 {
+		resp.Body.Close()
+		return nil, ErrForbidden
+	}
 	if resp.StatusCode != 200 {
 		return nil, errors.New("non 200 response code")
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	resp.Body.Close()
-
+	// decoded as it is read so the response is not held in memory alongside
+	// the config maps
+	defer resp.Body.Close()
 	var cl ConfigMapList
-	err = json.Unmarshal(data, &cl)
-	if err != nil {
+	if err := json.NewDecoder(resp.Body).Decode(&cl); err != nil {
 		return nil, err
 	}
 	return &cl, nil
@@ -142,14 +298,14 @@ func (k *k8sClient) createConfigMap(c *ConfigMap) error {
 		return fmt.Errorf("error encoding configmap %s: %v", c.Metadata.Name, err)
 	}
 	u := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps", k.endpoint, c.Metadata.Namespace)
-	resp, err := http.Post(u, "", bytes.NewReader(body))
+	resp, err := k.client.Post(u, "application/json", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("error creating configmap %s: %v", c.Metadata.Name, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 201 {
-		return fmt.Errorf("error creating configmap %s; got HTTP %v status code", c.Metadata.Name, resp.StatusCode)
+		return statusError(resp, "error creating configmap "+c.Metadata.Name)
 	}
 
 	return nil
@@ -174,12 +330,214 @@ func (k *k8sClient) updateConfigMap(c *ConfigMap) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("error updating configmap %s; got HTTP %v status code", c.Metadata.Name, resp.StatusCode)
+		return statusError(resp, "error updating configmap "+c.Metadata.Name)
 	}
 
 	return nil
 }
 
+func (k *k8sClient) deleteConfigMap(namespace, name string) error {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps/%s", k.endpoint, namespace, name)
+	request, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting configmap %s: %v", name, err)
+	}
+
+	resp, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error deleting configmap %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 202 && resp.StatusCode != 404 {
+		return fmt.Errorf("error deleting configmap %s; got HTTP %v status code", name, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (k *k8sClient) createEvent(e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event %s: %v", e.Reason, err)
+	}
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/events", k.endpoint, e.Metadata.Namespace)
+	resp, err := k.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating event %s: %v", e.Reason, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return fmt.Errorf("error creating event %s; got HTTP %v status code", e.Reason, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// watchConfigMaps streams config map events to fn until the server closes
+// the watch or done is closed.
+func (k *k8sClient) watchConfigMaps(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	return k.listWatch(func(q url.Values) string { return k.configMapsURL(namespace, q) }, query, done, func(e rawWatchEvent) error {
+		event := WatchEvent{Type: e.Type}
+		if err := json.Unmarshal(e.Object, &event.Object); err != nil {
+			return err
+		}
+		fn(event)
+		return nil
+	})
+}
+
+// listWatch watches the objects listed at the url built from query, starting
+// from the resource version of a list, so that existing objects are not
+// replayed as added. A restarted watch resumes from the last event it saw,
+// and lists again only when the server no longer has that version.
+func (k *k8sClient) listWatch(u func(url.Values) string, query url.Values, done <-chan struct{}, fn func(rawWatchEvent) error) error {
+	key := u(query)
+	k.mu.Lock()
+	version := k.watchVersions[key]
+	k.mu.Unlock()
+	setVersion := func(v string) {
+		k.mu.Lock()
+		if k.watchVersions == nil {
+			k.watchVersions = make(map[string]string)
+		}
+		k.watchVersions[key] = v
+		k.mu.Unlock()
+	}
+
+	if version == "" {
+		var err error
+		if version, err = k.listVersion(u, query); err != nil {
+			return err
+		}
+	}
+
+	wq := url.Values{}
+	for name, values := range query {
+		wq[name] = values
+	}
+	wq.Set("watch", "true")
+	wq.Set("resourceVersion", version)
+	wq.Set("allowWatchBookmarks", "true")
+	err := k.watch(u(wq), done, func(e rawWatchEvent) error {
+		if e.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(e.Object, &status)
+			if status.Code == http.StatusGone {
+				setVersion("")
+			}
+			return errors.Errorf("watch failed: %s", status.Message)
+		}
+		var obj struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(e.Object, &obj); err != nil {
+			return err
+		}
+		if obj.Metadata.ResourceVersion != "" {
+			setVersion(obj.Metadata.ResourceVersion)
+		}
+		if e.Type == "BOOKMARK" {
+			return nil
+		}
+		return fn(e)
+	})
+	if err == errWatchGone {
+		setVersion("")
+	}
+	return err
+}
+
+// listVersion returns the resource version of a list, fetching a single item
+// as only the version is needed.
+func (k *k8sClient) listVersion(u func(url.Values) string, query url.Values) (string, error) {
+	lq := url.Values{}
+	for name, values := range query {
+		lq[name] = values
+	}
+	lq.Set("limit", "1")
+	resp, err := k.client.Get(u(lq))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("error listing %s; got HTTP %v status code", u(query), resp.StatusCode)
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+type rawWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch streams events from a watch url to fn until the server closes the
+// watch or done is closed.
+func (k *k8sClient) watch(u string, done <-chan struct{}, fn func(rawWatchEvent) error) error {
+	resp, err := k.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return errWatchGone
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error watching %s; got HTTP %v status code", u, resp.StatusCode)
+	}
+
+	// closing the body unblocks the decoder when we are asked to stop
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			resp.Body.Close()
+		case <-finished:
+		}
+	}()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event rawWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to decode watch event")
+		}
+		if err := fn(event); err != nil {
+			return errors.Wrap(err, "failed to decode watch event")
+		}
+	}
+}
+
 func (k *k8sClient) waitForKubernetes() error {
 	timeout := time.After(time.Minute)
 	tick := time.Tick(5 * time.Second)
@@ -188,7 +546,7 @@ func (k *k8sClient) waitForKubernetes() error {
 		case <-timeout:
 			return errors.New("timed out waiting for Kubernetes")
 		case <-tick:
-			resp, err := http.Get(k.endpoint + "/api")
+			resp, err := k.client.Get(k.endpoint + "/api")
 			if err == nil {
 				resp.Body.Close()
 				return nil
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// what to do when sources have different values for a propagated label
+const (
+	labelConflictFirst = "first"
+	labelConflictOmit  = "omit"
+	labelConflictFail  = "fail"
+)
+
+func validateLabelConflictPolicy(policy string) error {
+	switch policy {
+	case labelConflictFirst, labelConflictOmit, labelConflictFail:
+		return nil
+	}
+	return errors.Errorf("invalid label conflict policy %q", policy)
+}
+
+// propagatedAnnotation lists the labels of the target copied from sources,
+// so those no longer on any source can be removed.
+const propagatedAnnotation = "configmap-aggregator/propagated-labels"
+
+// propagatedLabels collects the labels of sources to copy to the target.
+type propagatedLabels struct {
+	labels  map[string]string
+	omitted map[string]bool
+}
+
+func newPropagatedLabels() *propagatedLabels {
+	return &propagatedLabels{
+		labels:  make(map[string]string),
+		omitted: make(map[string]bool),
+	}
+}
+
+// propagateLabels records the labels of cm matching a propagated pattern.
+func (c *controller) propagateLabels(p *propagatedLabels, cm *ConfigMap) error {
+	for _, k := range sortedKeys(cm.Metadata.Labels) {
+		v := cm.Metadata.Labels[k]
+		if !matchAny(c.propagateLabelPatterns, k) {
+			continue
+		}
+		old, ok := p.labels[k]
+		if !ok {
+			p.labels[k] = v
+			continue
+		}
+		if old == v {
+			continue
+		}
+		switch c.labelConflictPolicy {
+		case labelConflictOmit:
+			p.omitted[k] = true
+		case labelConflictFail:
+			return errors.Errorf("label %s of %s/%s is %q, but %q on another source", k, cm.Metadata.Namespace, cm.Metadata.Name, v, old)
+		}
+	}
+	return nil
+}
+
+// result returns the labels to set on the target.
+func (p *propagatedLabels) result() map[string]string {
+	for k := range p.omitted {
+		delete(p.labels, k)
+	}
+	return p.labels
+}
+
+// staleLabels returns the labels existing got from sources that cm no longer
+// has.
+func staleLabels(existing, cm *ConfigMap) map[string]bool {
+	stale := make(map[string]bool)
+	for _, k := range strings.Split(existing.Metadata.Annotations[propagatedAnnotation], ",") {
+		if _, ok := cm.Metadata.Labels[k]; k != "" && !ok {
+			stale[k] = true
+		}
+	}
+	return stale
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+const (
+	limitPolicySkip = "skip"
+	limitPolicyFail = "fail"
+)
+
+// aggregateSize tracks what has been added to the aggregate so far.
+type aggregateSize struct {
+	sources int
+	keys    int
+	bytes   int
+}
+
+func dataSize(data map[string]string) int {
+	n := 0
+	for k, v := range data {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+func (s *aggregateSize) add(cm *ConfigMap) {
+	s.sources++
+	s.keys += len(cm.Data)
+	s.bytes += dataSize(cm.Data)
+}
+
+// checkLimits returns the reason and an error if adding cm would exceed a
+// configured limit. s is the size of the whole aggregate and ns is what the
+// source's namespace has contributed so far. A limit of zero means unlimited.
+func (c *controller) checkLimits(cm *ConfigMap, s, ns aggregateSize) (string, error) {
+	if c.maxSources > 0 && s.sources+1 > c.maxSources {
+		return "max-sources", fmt.Errorf("more than %d source config maps", c.maxSources)
+	}
+	if c.maxKeys > 0 && s.keys+len(cm.Data) > c.maxKeys {
+		return "max-keys", fmt.Errorf("more than %d keys", c.maxKeys)
+	}
+	if c.maxBytes > 0 && s.bytes+dataSize(cm.Data) > c.maxBytes {
+		return "max-bytes", fmt.Errorf("more than %d bytes", c.maxBytes)
+	}
+	if c.namespaceMaxKeys > 0 && ns.keys+len(cm.Data) > c.namespaceMaxKeys {
+		return "namespace-max-keys", fmt.Errorf("namespace %s would contribute more than %d keys", cm.Metadata.Namespace, c.namespaceMaxKeys)
+	}
+	if c.namespaceMaxBytes > 0 && ns.bytes+dataSize(cm.Data) > c.namespaceMaxBytes {
+		return "namespace-max-bytes", fmt.Errorf("namespace %s would contribute more than %d bytes", cm.Metadata.Namespace, c.namespaceMaxBytes)
+	}
+	return "", nil
+}
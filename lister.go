@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// ConfigMapLister lists the config maps to aggregate in a namespace. An
+// empty namespace means all namespaces.
+type ConfigMapLister interface {
+	List(namespace, selector string) (*ConfigMapList, error)
+}
+
+// watcher is implemented by listers that can stream changes.
+type watcher interface {
+	watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error
+}
+
+// watchable reports whether l can stream changes. Listers wrapping others
+// can if all of the wrapped listers can.
+func watchable(l ConfigMapLister) bool {
+	switch l := l.(type) {
+	case *retryingLister:
+		return watchable(l.ConfigMapLister)
+	case *cachingLister:
+		return watchable(l.ConfigMapLister)
+	case *fallbackLister:
+		return watchable(l.ConfigMapLister)
+	case *multiLister:
+		for _, n := range l.listers {
+			if !watchable(n.lister) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok := l.(watcher)
+	return ok
+}
+
+type configMapLister struct {
+	client *k8sClient
+}
+
+func (l *configMapLister) List(namespace, selector string) (*ConfigMapList, error) {
+	return l.client.getConfigMaps(namespace, selector)
+}
+
+func (l *configMapLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	return l.client.watchConfigMaps(namespace, selector, done, fn)
+}
+
+// resourceLister lists arbitrary resources, such as custom resources, and
+// presents a map field of each as config map data.
+type resourceLister struct {
+	client   *k8sClient
+	resource *groupVersionResource
+	field    []string
+}
+
+// toConfigMap converts an untyped object. Values of the data field that are
+// not strings are JSON encoded.
+func (l *resourceLister) toConfigMap(raw json.RawMessage) (*ConfigMap, error) {
+	var obj struct {
+		Metadata Metadata `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	var u map[string]interface{}
+	if err := json.Unmarshal(raw, &u); err != nil {
+		return nil, err
+	}
+
+	cm := newConfigMap(obj.Metadata.Namespace, obj.Metadata.Name)
+	cm.Metadata = obj.Metadata
+	v, _ := getField(u, l.field)
+	m, _ := v.(map[string]interface{})
+	for k, v := range m {
+		if s, ok := v.(string); ok {
+			cm.Data[k] = s
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		cm.Data[k] = string(b)
+	}
+	return cm, nil
+}
+
+func (l *resourceLister) url(namespace string, query url.Values) string {
+	u := l.client.endpoint + l.resource.path(namespace, "")
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+	return u
+}
+
+func (l *resourceLister) List(namespace, selector string) (*ConfigMapList, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	resp, err := l.client.client.Get(l.url(namespace, query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 403 {
+		return nil, ErrForbidden
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error listing %s; got HTTP %v status code", l.resource.Resource, resp.StatusCode)
+	}
+
+	var list struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	var cl ConfigMapList
+	for _, item := range list.Items {
+		cm, err := l.toConfigMap(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s", l.resource.Resource)
+		}
+		cl.Items = append(cl.Items, *cm)
+	}
+	return &cl, nil
+}
+
+func (l *resourceLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	return l.client.listWatch(func(q url.Values) string { return l.url(namespace, q) }, query, done, func(e rawWatchEvent) error {
+		cm, err := l.toConfigMap(e.Object)
+		if err != nil {
+			return err
+		}
+		fn(WatchEvent{Type: e.Type, Object: *cm})
+		return nil
+	})
+}
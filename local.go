@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// serviceAccountNamespaceFile is mounted into every pod with a service
+// account token.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+var local bool
+
+// podNamespace returns the namespace the aggregator runs in, from the
+// POD_NAMESPACE environment variable set with the downward API, or the
+// namespace of the service account.
+func podNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	data, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to determine the pod namespace: set POD_NAMESPACE")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// defaultNamespace makes a rule without namespaces aggregate from, and write
+// to, namespace.
+func (r *rule) defaultNamespace(namespace string) {
+	if len(r.Namespaces) == 0 && r.NamespaceSelector == "" {
+		r.Namespaces = []string{namespace}
+	}
+	if r.OutputDir == "" && r.TargetNamespace == "" {
+		r.TargetNamespace = namespace
+	}
+}
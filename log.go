@@ -0,0 +1,23 @@
+package main
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// logf logs a line prefixed with the rule name, so the logs of rules can
+// be told apart.
+func (c *controller) logf(format string, args ...interface{}) {
+	log.Printf("%s: "+format, append([]interface{}{c.name}, args...)...)
+}
+
+// warn logs a condition that does not fail the sync, unless running in strict
+// mode in which case it is returned as an error.
+func (c *controller) warn(format string, args ...interface{}) error {
+	if c.strict {
+		return errors.Errorf(format, args...)
+	}
+	c.logf(format, args...)
+	return nil
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -17,11 +25,177 @@ import (
 )
 
 type controller struct {
-	client          *k8sClient
-	targetNamespace string
-	targetName      string
-	selector        string
-	namespaces      []string
+	client *k8sClient
+	lister ConfigMapLister
+	// used to request an immediate sync
+	trigger chan struct{}
+	// identifies the rule in logs
+	name               string
+	syncInterval       time.Duration
+	schedule           *cronSchedule
+	discoverNamespaces bool
+	listConcurrency    int
+	status             *syncStatus
+	// source changes seen by watches and not yet in the target
+	observed *observedChanges
+	// keys of the last aggregate by source, to tell which observed changes
+	// reached the target
+	sourceKeys        map[string][]string
+	compressThreshold int
+	lineEndings       string
+	trailingNewline   string
+	compareMode       string
+	// substrings removed from values before they are compared
+	volatilePatterns   []*regexp.Regexp
+	emptyPolicy        string
+	minSources         int
+	maxRemovedFraction float64
+	verifyWrites       bool
+	verifyRetries      int
+	webhooks           []*webhook
+	webhookSecret      []byte
+	webhookOnStart     bool
+	// only changes to keys matching these call webhooks, if set
+	significantKeys []string
+	synced          bool
+	// called after unhealthyAfter consecutive failed syncs, and on recovery
+	unhealthyWebhook *webhook
+	healthyWebhook   *webhook
+	unhealthyAfter   int
+	failures         int
+	unhealthy        bool
+	targetNamespace  string
+	targetName       string
+	// metadata set on the target whenever it is written
+	targetLabels      map[string]string
+	targetAnnotations map[string]string
+	// labels targets so stale ones can be garbage collected
+	instance string
+	ruleID   string
+	// only aggregate namespaces of this shard
+	shard *shard
+	// namespaces to list again, in watch mode
+	queue *namespaceQueue
+	// what each source contributed to the last aggregate
+	contributions *contributionCache
+	// state kept across restarts
+	state     *stateStore
+	persisted *ruleState
+	// resource versions of the sources of the last aggregate
+	lastSourceVersions string
+	// keys of the target on startup, kept while namespaces are skipped
+	warm              map[string]string
+	skippedNamespaces int
+	// targets of every rule, as namespace/name, which are never sources
+	targets map[string]bool
+	// aggregate targets of other aggregators
+	allowChained bool
+	// record the version of each source in an annotation of the target
+	recordSources bool
+	// only sources owned by a matching object are aggregated
+	owners []*ownerFilter
+	// sources younger than minAge, or created outside of the range, are skipped
+	minAge        time.Duration
+	createdAfter  time.Time
+	createdBefore time.Time
+	// when the sync scheduled for the first too young source to mature runs
+	matureRecheck time.Time
+	// labels of sources copied to the target
+	propagateLabelPatterns []string
+	labelConflictPolicy    string
+	// sources matching any of the selectors are aggregated
+	selectors         []string
+	namespaces        []string
+	namespaceSelector string
+	coalesceWindow    time.Duration
+	minWriteInterval  time.Duration
+	lastWrite         time.Time
+	maxSources        int
+	maxKeys           int
+	maxBytes          int
+	limitPolicy       string
+	memoryLimit       int
+	// per source namespace quotas
+	namespaceMaxKeys  int
+	namespaceMaxBytes int
+	// values larger than this are skipped
+	maxValueBytes int
+	strict        bool
+	// forbidden namespaces are skipped rather than failing the sync
+	skipForbidden bool
+	validators    []*keyValidator
+	keyTemplate   *template.Template
+	sourceMode    string
+	// when set, the aggregate is a single nested document under this key
+	documentKey string
+	envKeys     string
+	// combine every value into a single key
+	mergeMode string
+	mergeKey  string
+	// command that must accept the merged value
+	checkCommand string
+	// write with server-side apply and annotations for GitOps controllers
+	gitops bool
+	// command that rewrites the aggregate
+	transformCommand string
+	// command that must accept the output before it is written
+	validateCommand *template.Template
+	validatedHash   string
+	// staging target written before the target
+	stagingName    string
+	stagingDir     string
+	promoteAfter   time.Duration
+	promoteWebhook *webhook
+	stagedHash     string
+	stagedAt       time.Time
+	promotedHash   string
+	// only apply changes approved on the target
+	requireApproval bool
+	// results of the last sync, for the onetime summary
+	lastSources int
+	lastKeys    int
+	lastChanges *changeSet
+	// log the changes a sync would make instead of making them
+	dryRun bool
+	// report drift of the target instead of writing it
+	notifyOnly bool
+	driftHash  string
+	// hold back changes during a freeze
+	freezeWindows   []*freezeWindow
+	freezeConfigMap string
+	pauseMarkers    []*pauseMarker
+	freezeEnd       time.Time
+	freezeRecheck   time.Time
+	frozenHash      string
+	// sources skipped for exceeding a limit in the last sync
+	overLimit map[string]bool
+	// server blocks of the last Corefile merge
+	corefileFragments []corefileFragment
+	corefileConflicts map[string]bool
+	// only write keys of the target matching these patterns
+	targetKeys []string
+	// resolve ${key} references in values
+	interpolation bool
+	// environment variables that values may reference
+	substituteEnv []string
+	// when set, the aggregate is written to a field of this resource
+	// instead of a config map
+	targetResource *groupVersionResource
+	targetKind     string
+	targetField    []string
+	// when set, the aggregate is written to files in this directory instead
+	outputDir string
+	// maximum number of files written at once
+	writeConcurrency int
+	// number of lines kept in the changelog in outputDir
+	changelogEntries int
+	// remove or overwrite files in outputDir that were not written by us
+	forceClean   bool
+	fileTypes    []*fileType
+	contentTypes map[string]string
+	// a file or url to publish the aggregate to as a tar.gz or zip archive
+	archive  string
+	archived bool
 }
 
 var rootCmd = &cobra.Command{
@@ -31,74 +205,840 @@ var rootCmd = &cobra.Command{
 }
 
 var (
-	selector, endpoint string
+	selectors          []string
+	matchLabels        []string
+	matchExpressions   []string
+	endpoint           string
 	namespaces         []string
+	namespaceSelector  string
 	onetime            bool
+	watch              bool
 	syncInterval       time.Duration
+	schedule           string
+	coalesceWindow     time.Duration
+	minWriteInterval   time.Duration
+	maxSources         int
+	maxKeys            int
+	maxBytes           int
+	limitPolicy        string
+	memoryLimit        int
+	namespaceMaxKeys   int
+	namespaceMaxBytes  int
+	maxValueBytes      int
+	strict             bool
+	skipForbidden      bool
+	validateSpecs      []string
+	targetResource     string
+	targetKind         string
+	targetField        string
+	sourceResource     string
+	sourceField        string
+	rulesFile          string
+	metricsAddress     string
+	listConcurrency    int
+	compressThreshold  int
+	lineEndings        string
+	trailingNewline    string
+	compareMode        string
+	ignorePatterns     []string
+	emptyPolicy        string
+	minSources         int
+	maxRemovedFraction float64
+	verifyWrites       bool
+	verifyRetries      int
+	webhookURLs        []string
+	webhookSecretFile  string
+	webhookOnStart     bool
+	outputDir          string
+	changelogEntries   int
+	writeConcurrency   int
+	forceClean         bool
+	verify             bool
+	keyTemplate        string
+	fileTypeSpecs      []string
+	archive            string
+	waitForKeys        []string
+	waitTimeout        time.Duration
+	unhealthyURL       string
+	healthyURL         string
+	unhealthyAfter     int
+	targetLabelSpecs   []string
+	targetAnnotSpecs   []string
+	propagateLabels    []string
+	labelConflict      string
+	instance           string
+	allowChained       bool
+	ownerSpecs         []string
+	minAge             time.Duration
+	createdAfter       string
+	createdBefore      string
+	recordSources      bool
+	sourceMode         string
+	documentKey        string
+	envKeys            string
+	mergeMode          string
+	mergeKey           string
+	checkCommand       string
+	gitops             bool
+	transformCommand   string
+	validateCommand    string
+	stagingName        string
+	stagingDir         string
+	promoteAfter       time.Duration
+	promoteWebhookURL  string
+	requireApproval    bool
+	freezeSpecs        []string
+	notifyOnly         bool
+	listRetries        int
+	sourceEndpoints    []string
+	fallbackEndpoints  []string
+	listCacheTTL       time.Duration
+	shardSpec          string
+	persistFile        string
+	warmStart          bool
+	listBackoff        time.Duration
+	dryRun             bool
+	summaryFile        string
+	freezeConfigMap    string
+	pauseSpecs         []string
+	targetKeys         []string
+	significantKeys    []string
+	interpolation      bool
+	substituteEnv      []string
 )
 
 func main() {
-	rootCmd.PersistentFlags().StringVarP(&selector, "selector", "s", "", "label selector")
+	rootCmd.PersistentFlags().StringArrayVarP(&selectors, "selector", "s", nil, "label selector. can be used multiple times to aggregate config maps matching any of them.")
+	rootCmd.PersistentFlags().StringArrayVarP(&matchLabels, "match-label", "", nil, "label, as key=value, sources must have. combined with selector. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&matchExpressions, "match-expression", "", nil, "selector requirement, such as \"env in (prod,staging)\", sources must match. combined with selector. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&ownerSpecs, "owner", "", nil, "only aggregate config maps owned by an object, as <kind>[/<name-pattern>], such as Deployment/prometheus-*. can be used multiple times.")
+	rootCmd.PersistentFlags().DurationVarP(&minAge, "min-age", "", 0, "skip config maps created less than this long ago, such as while a release is being applied.")
+	rootCmd.PersistentFlags().StringVarP(&createdAfter, "created-after", "", "", "only aggregate config maps created at or after this RFC3339 time.")
+	rootCmd.PersistentFlags().StringVarP(&createdBefore, "created-before", "", "", "only aggregate config maps created before this RFC3339 time.")
 	rootCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", "http://127.0.0.1:8001", "kubernetes endpoint")
+	rootCmd.PersistentFlags().StringVarP(&tokenFile, "token-file", "", "", "bearer token for the endpoint, read again every minute so rotated service account tokens are picked up.")
+	rootCmd.PersistentFlags().StringVarP(&execCredential, "exec-credential", "", "", "command of an exec credential plugin, such as \"aws-iam-authenticator token -i cluster\", run again when its token expires.")
+	rootCmd.PersistentFlags().StringVarP(&apiCAFile, "ca-file", "", "", "certificate authority of the endpoint when it is not a kubectl proxy.")
+	rootCmd.PersistentFlags().StringVarP(&userAgentSuffix, "user-agent-suffix", "", "", "appended to the configmap-aggregator/<version> user agent of API requests.")
+	rootCmd.PersistentFlags().BoolVarP(&local, "local", "", false, "default the source and target namespaces to the namespace the pod runs in, from POD_NAMESPACE or the service account, so only the target name is given.")
 	rootCmd.PersistentFlags().StringArrayVarP(&namespaces, "namespace", "n", nil, "namespace to query. can be used multiple times. default is all namespaces")
+	rootCmd.PersistentFlags().StringVarP(&namespaceSelector, "namespace-selector", "", "", "label selector for namespaces to query. can not be used with namespace.")
 	rootCmd.PersistentFlags().BoolVarP(&onetime, "onetime", "o", false, "run one time and exit.")
 	rootCmd.PersistentFlags().DurationVarP(&syncInterval, "sync-interval", "i", (60 * time.Second), "the time duration between template processing.")
+	rootCmd.PersistentFlags().StringVarP(&schedule, "schedule", "", "", "cron schedule, such as \"*/5 * * * *\", to sync on instead of sync-interval.")
+	rootCmd.PersistentFlags().BoolVarP(&watch, "watch", "w", false, "watch config maps and sync on changes. sync-interval is used for periodic full resyncs.")
+	rootCmd.PersistentFlags().DurationVarP(&coalesceWindow, "coalesce-window", "", (2 * time.Second), "in watch mode, time to wait for more changes before syncing.")
+	rootCmd.PersistentFlags().DurationVarP(&minWriteInterval, "min-write-interval", "", (10 * time.Second), "in watch mode, minimum time between updates of the target config map.")
+	rootCmd.PersistentFlags().IntVarP(&maxSources, "max-sources", "", 0, "maximum number of source config maps to aggregate. 0 is unlimited.")
+	rootCmd.PersistentFlags().IntVarP(&maxKeys, "max-keys", "", 0, "maximum number of keys in the target config map. 0 is unlimited.")
+	rootCmd.PersistentFlags().IntVarP(&maxBytes, "max-bytes", "", 0, "maximum size in bytes of the aggregated data. 0 is unlimited.")
+	rootCmd.PersistentFlags().IntVarP(&memoryLimit, "memory-limit", "", 0, "memory in bytes the aggregator may use. syncs needing more fail and leave the target as it is. 0 is unlimited.")
+	rootCmd.PersistentFlags().IntVarP(&namespaceMaxKeys, "namespace-max-keys", "", 0, "maximum number of keys each source namespace may contribute. 0 is unlimited.")
+	rootCmd.PersistentFlags().IntVarP(&namespaceMaxBytes, "namespace-max-bytes", "", 0, "maximum size in bytes each source namespace may contribute. 0 is unlimited.")
+	rootCmd.PersistentFlags().StringVarP(&limitPolicy, "limit-policy", "", limitPolicySkip, "what to do when a source exceeds a limit: skip or fail.")
+	rootCmd.PersistentFlags().BoolVarP(&strict, "strict", "", false, "fail the sync on key conflicts, invalid keys, oversized values, exceeded limits, and skipped namespaces.")
+	rootCmd.PersistentFlags().IntVarP(&maxValueBytes, "max-value-bytes", "", 0, "skip values larger than this many bytes. 0 is unlimited.")
+	rootCmd.PersistentFlags().BoolVarP(&skipForbidden, "skip-forbidden", "", false, "skip source namespaces that cannot be read instead of failing the sync.")
+	rootCmd.PersistentFlags().StringArrayVarP(&validateSpecs, "validate", "", nil, "validate values of keys matching a pattern, as <key-pattern>=<json-schema-file|webhook-url|grafana-dashboard>. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&targetLabelSpecs, "target-label", "", nil, "label, as key=value, to set on the target. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&targetAnnotSpecs, "target-annotation", "", nil, "annotation, as key=value, to set on the target. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&propagateLabels, "propagate-label", "", nil, "copy source labels matching this glob pattern to the target. can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&labelConflict, "label-conflict", "", labelConflictFirst, "what to do when sources have different values for a propagated label: first, omit, or fail.")
+	rootCmd.PersistentFlags().StringVarP(&targetResource, "target-resource", "", "", "write the aggregate to a resource, as group/version/resource, instead of a config map.")
+	rootCmd.PersistentFlags().StringVarP(&targetKind, "target-kind", "", "", "kind of the target resource. required when target-resource is set.")
+	rootCmd.PersistentFlags().StringVarP(&targetField, "target-field", "", ".data", "JSONPath of the field in the target resource that holds the aggregate.")
+	rootCmd.PersistentFlags().StringVarP(&sourceResource, "source-resource", "", "", "aggregate a field of this resource, as group/version/resource, instead of config maps.")
+	rootCmd.PersistentFlags().StringArrayVarP(&fallbackEndpoints, "fallback-endpoint", "", nil, "endpoint of the same cluster to list sources from when the endpoint fails, tried in order. may be given multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&sourceEndpoints, "source-endpoint", "", nil, "also aggregate sources from another API server, as <name>=<endpoint>, optionally followed by token-file=, ca-file=, cert-file=, key-file=, or exec-credential= options. may be given multiple times.")
+	rootCmd.PersistentFlags().DurationVarP(&listCacheTTL, "list-cache-ttl", "", 0, "share lists of the same namespace and selector between rules for this long. disabled if 0.")
+	rootCmd.PersistentFlags().IntVarP(&listRetries, "list-retries", "", 3, "number of times to retry listing sources after an error. 0 disables retries.")
+	rootCmd.PersistentFlags().DurationVarP(&listBackoff, "list-backoff", "", (500 * time.Millisecond), "initial delay between list retries, doubled after each retry.")
+	rootCmd.PersistentFlags().StringVarP(&sourceField, "source-field", "", ".data", "JSONPath of the field in source resources to aggregate.")
+	rootCmd.PersistentFlags().StringVarP(&keyTemplate, "key-template", "", defaultKeyTemplate, "Go template for aggregated key and output file names, given .Namespace, .ConfigMap, .Key, .Priority, and .Source, or the include-dir or grafana preset.")
+	rootCmd.PersistentFlags().StringVarP(&sourceMode, "source-mode", "", sourceModeKeys, "how sources are aggregated: keys, one key per key of the source, or json, one <namespace>_<name>.json document per source.")
+	rootCmd.PersistentFlags().StringVarP(&documentKey, "document-key", "", "", "write the aggregate as a single JSON document, keyed by namespace then config map, under this key.")
+	rootCmd.PersistentFlags().StringVarP(&envKeys, "env-keys", "", "", "make keys usable with envFrom: rewrite them into environment variable names, or reject keys that are not. disabled if empty.")
+	rootCmd.PersistentFlags().BoolVarP(&gitops, "gitops", "", false, "write the target with server-side apply and annotate it so Argo CD and Flux do not report or revert it as drift.")
+	rootCmd.PersistentFlags().StringVarP(&mergeMode, "merge", "", "", "combine every value into a single key: helm-values, prometheus-rules, prometheus-scrape-configs, concat, fluent-bit, or corefile. disabled if empty.")
+	rootCmd.PersistentFlags().StringVarP(&mergeKey, "merge-key", "", "", "key to write merged values to. defaults to one suiting the merge mode.")
+	rootCmd.PersistentFlags().BoolVarP(&interpolation, "interpolate", "", false, "replace ${<key>} in values with the value of that aggregated key. $${<key>} is left as ${<key>}.")
+	rootCmd.PersistentFlags().StringArrayVarP(&substituteEnv, "substitute-env", "", nil, "replace ${<name>} in values with the environment variable, if its name matches this glob pattern. can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&targetKeys, "target-key", "", nil, "only write keys of the target matching this glob pattern, leaving other keys to their owners. can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&transformCommand, "transform-command", "", "", "command that rewrites the aggregate before it is written. it reads and writes a JSON object of keys and values, or modifies the files in the directory {} is replaced by.")
+	rootCmd.PersistentFlags().StringVarP(&validateCommand, "validate-cmd", "", "", "command that must succeed on the output before it is written, as a Go template given .Dir, a directory holding a file per key, such as \"nginx -t -c {{.Dir}}/nginx.conf\".")
+	rootCmd.PersistentFlags().StringVarP(&stagingName, "staging-name", "", "", "config map in the target namespace that changes are written to before they are promoted to the target.")
+	rootCmd.PersistentFlags().StringVarP(&stagingDir, "staging-dir", "", "", "directory that changes are written to before they are promoted to the output directory.")
+	rootCmd.PersistentFlags().DurationVarP(&promoteAfter, "promote-after", "", 0, "how long changes stay in the staging target before they are promoted.")
+	rootCmd.PersistentFlags().StringVarP(&promoteWebhookURL, "promote-webhook", "", "", "url that must accept a staged change before it is promoted, with the same options as --webhook.")
+	rootCmd.PersistentFlags().BoolVarP(&requireApproval, "require-approval", "", false, "only apply changes to the target once its "+approveAnnotation+" annotation is set to their hash.")
+	rootCmd.PersistentFlags().StringArrayVarP(&freezeSpecs, "freeze", "", nil, "hold back changes for a duration from every match of a cron schedule, as \"<schedule> <duration>\", such as \"0 18 * * 5 63h\". can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&freezeConfigMap, "freeze-configmap", "", "", "hold back changes while the \""+frozenKey+"\" key of this config map, as <namespace>/<name>, is \"true\".")
+	rootCmd.PersistentFlags().StringArrayVarP(&pauseSpecs, "pause-while", "", nil, "hold back changes while a resource shows a sync in progress, as \"<resource> <namespace>/<name> <annotation>[=<value>]\" or with a field such as .status.operationState.phase=Running. can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&checkCommand, "check-command", "", "", "command that must succeed on the merged value before it is written, such as \"fluent-bit --dry-run -c {}\". {} is replaced by a file holding the value.")
+	rootCmd.PersistentFlags().StringVarP(&outputDir, "output-dir", "", "", "write each key of the aggregate to a file in this directory instead of a target config map.")
+	rootCmd.PersistentFlags().IntVarP(&writeConcurrency, "write-concurrency", "", 4, "maximum number of files to write at once in the output directory.")
+	rootCmd.PersistentFlags().IntVarP(&changelogEntries, "changelog-entries", "", 0, "keep this many lines of change history in CHANGELOG.jsonl in the output directory.")
+	rootCmd.PersistentFlags().StringArrayVarP(&fileTypeSpecs, "file-type", "", nil, "in output-dir mode, a file pattern followed by options such as \"ext=conf content-type=text/plain render=true\". can be used multiple times.")
+	rootCmd.PersistentFlags().BoolVarP(&forceClean, "force-clean", "", false, "take over an output directory holding files not written by the aggregator, removing or overwriting them.")
+	rootCmd.PersistentFlags().StringVarP(&archive, "archive", "", "", "also publish the aggregate as a .tar.gz or .zip archive to this file, or url to upload it to with PUT.")
+	rootCmd.PersistentFlags().StringVarP(&rulesFile, "rules-file", "r", "", "JSON file with a list of rules, each describing a target to aggregate into.")
+	rootCmd.PersistentFlags().IntVarP(&listConcurrency, "list-concurrency", "", 4, "maximum number of namespaces to list at once.")
+	rootCmd.PersistentFlags().IntVarP(&compressThreshold, "compress-threshold", "", 0, "gzip values larger than this many bytes into binaryData. 0 disables compression.")
+	rootCmd.PersistentFlags().StringVarP(&lineEndings, "line-endings", "", lineEndingsKeep, "line endings of values: keep, or lf to convert CRLF to LF.")
+	rootCmd.PersistentFlags().StringVarP(&trailingNewline, "trailing-newline", "", trailingNewlineKeep, "trailing newlines of values: keep, add, strip, or single.")
+	rootCmd.PersistentFlags().StringVarP(&compareMode, "compare", "", compareExact, "how values are compared when deciding whether to update the target: exact, trim, or semantic.")
+	rootCmd.PersistentFlags().StringArrayVarP(&ignorePatterns, "ignore-pattern", "", nil, "regular expression of volatile substrings, such as timestamps, removed from values before they are compared. can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&emptyPolicy, "empty-policy", "", emptyPolicyEmpty, "what to do when the selector matches no config maps: empty the target, keep it as is, or fail.")
+	rootCmd.PersistentFlags().IntVarP(&minSources, "min-sources", "", 0, "refuse to update the target when fewer source config maps are found. 0 disables the check.")
+	rootCmd.PersistentFlags().Float64VarP(&maxRemovedFraction, "max-removed-fraction", "", 0, "refuse to update the target when a sync would remove more than this fraction of its keys. 0 disables the check.")
+	rootCmd.PersistentFlags().BoolVarP(&verifyWrites, "verify-writes", "", false, "read the target back after writing it and check it matches the aggregate.")
+	rootCmd.PersistentFlags().IntVarP(&verifyRetries, "verify-retries", "", 2, "number of times to retry a write that fails verification.")
+	rootCmd.PersistentFlags().StringArrayVarP(&webhookURLs, "webhook", "", nil, "url to POST to when the target changes, optionally followed by options such as \"codes=200,202 body=ok field=.status:ok timeout=5s bearer-token-file=/path\". can be used multiple times.")
+	rootCmd.PersistentFlags().StringArrayVarP(&significantKeys, "significant-key", "", nil, "only call webhooks when a key matching this glob pattern changes, so changes to other keys update the target without reloads. can be used multiple times.")
+	rootCmd.PersistentFlags().StringVarP(&webhookSecretFile, "webhook-secret-file", "", "", "file holding a secret used to sign webhook payloads with HMAC-SHA256.")
+	rootCmd.PersistentFlags().StringVarP(&unhealthyURL, "unhealthy-webhook", "", "", "url to POST to after unhealthy-after consecutive failed syncs, with the same options as webhook.")
+	rootCmd.PersistentFlags().StringVarP(&healthyURL, "healthy-webhook", "", "", "url to POST to when syncs succeed again after unhealthy-webhook was called.")
+	rootCmd.PersistentFlags().IntVarP(&unhealthyAfter, "unhealthy-after", "", 3, "number of consecutive failed syncs before unhealthy-webhook is called.")
+	rootCmd.PersistentFlags().BoolVarP(&webhookOnStart, "webhook-on-start", "", false, "call webhooks after the first successful sync even if nothing changed.")
+	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "", false, "log the changes each sync would make without writing anything, calling webhooks, or recording events.")
+	rootCmd.PersistentFlags().BoolVarP(&notifyOnly, "notify-only", "", false, "never write anything, but call webhooks and update metrics when the target drifts from the aggregate.")
+	rootCmd.PersistentFlags().StringVarP(&summaryFile, "summary", "", "", "with onetime, write a JSON summary of the run to this file, or stdout if -.")
+	rootCmd.PersistentFlags().BoolVarP(&verify, "verify", "", false, "compare the target with the aggregate without writing it, list drifted keys, and exit non-zero if any.")
+	rootCmd.PersistentFlags().StringSliceVarP(&waitForKeys, "wait-for-keys", "", nil, "in onetime mode, comma separated keys that must be in the aggregate before it is written.")
+	rootCmd.PersistentFlags().DurationVarP(&waitTimeout, "wait-timeout", "", (2 * time.Minute), "how long to wait for wait-for-keys before failing.")
+	rootCmd.PersistentFlags().BoolVarP(&allowChained, "allow-chained", "", false, "aggregate config maps that are themselves the target of an aggregator.")
+	rootCmd.PersistentFlags().BoolVarP(&recordSources, "record-sources", "", false, "record the resourceVersion of each source in the configmap-aggregator/sources annotation of the target.")
+	rootCmd.PersistentFlags().StringVarP(&shardSpec, "shard", "", "", "only aggregate the namespaces of shard <index>/<count>, counting from 0, into targets suffixed with -<index>.")
+	rootCmd.PersistentFlags().BoolVarP(&warmStart, "warm-start", "", false, "on startup, keep the keys of the existing target until every source namespace can be listed.")
+	rootCmd.PersistentFlags().StringVarP(&persistFile, "state-file", "", "", "remember hashes of what was written, staged, archived, and notified in this file, so a restart does not repeat them.")
+	rootCmd.PersistentFlags().StringVarP(&instance, "instance", "", "", "label targets with this identifier, and delete targets labeled with it that no rule writes anymore.")
+	rootCmd.PersistentFlags().StringVarP(&metricsAddress, "metrics-address", "", "", "address to serve prometheus metrics and health checks on. disabled if empty.")
+
+	rbacCmd.Flags().StringVarP(&serviceAccount, "service-account", "", "configmap-aggregator", "name of the service account in the target namespace")
+
+	waitCmd.Flags().StringArrayVarP(&waitAnnotations, "annotation", "", []string{"configmap-aggregator/version"}, "annotation, as key or key=value, the target must carry. can be used multiple times.")
+	waitCmd.Flags().DurationVarP(&waitCmdTimeout, "timeout", "", (2 * time.Minute), "how long to wait before failing.")
+
+	benchCmd.Flags().IntVarP(&benchSources, "sources", "", 1000, "number of synthetic source config maps.")
+	benchCmd.Flags().IntVarP(&benchKeys, "keys", "", 5, "number of keys in each source.")
+	benchCmd.Flags().IntVarP(&benchValueSize, "value-size", "", 1024, "size of each value in bytes.")
+	benchCmd.Flags().IntVarP(&benchIterations, "iterations", "", 20, "number of incremental syncs to measure.")
+
+	importCmd.Flags().StringArrayVarP(&importLabelSpecs, "label", "", nil, "label, as key=value, set on each source and used to select them. can be used multiple times.")
+
+	manifestCmd.Flags().StringVarP(&serviceAccount, "service-account", "", "configmap-aggregator", "name of the service account in the target namespace")
+	manifestCmd.Flags().StringVarP(&image, "image", "", defaultImage(), "configmap-aggregator image")
+	manifestCmd.Flags().StringVarP(&proxyImage, "proxy-image", "", "bitnami/kubectl:latest", "image used to run kubectl proxy")
+
+	rootCmd.AddCommand(rbacCmd, manifestCmd, versionCmd, waitCmd, benchCmd, snapshotCmd, replayCmd, importCmd, exportCmd)
+	// cobra rejects positional arguments on a root command that has
+	// subcommands, so they are removed when the target arguments are given
+	if runsAggregator(os.Args[1:]) {
+		rootCmd.ResetCommands()
+	}
 
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// runsAggregator reports whether args are target arguments of the
+// aggregator itself rather than a subcommand: the first of them is not the
+// name of a subcommand, or they follow --, so that a target namespace can
+// be named like a subcommand.
+func runsAggregator(args []string) bool {
+	for i, a := range args {
+		if a == "--" {
+			cmd, _, _ := rootCmd.Find(args[:i])
+			return cmd == rootCmd
+		}
+	}
+	if len(args) > 0 && args[0] == "help" {
+		return false
+	}
+	cmd, _, err := rootCmd.Find(args)
+	return cmd == rootCmd && err != nil
+}
+
 func runAggregator(cmd *cobra.Command, args []string) {
-	if len(args) != 2 {
-		log.Fatal("namespace and name of target configmap is required")
+	if rulesFile != "" && len(args) != 0 {
+		log.Fatal("target configmap can not be given with rules-file")
+	}
+	if schedule != "" && cmd.Flags().Changed("sync-interval") {
+		log.Fatal("schedule and sync-interval can not be used together")
+	}
+	rules, _, err := rulesFromArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var sh *shard
+	if shardSpec != "" {
+		if sh, err = parseShard(shardSpec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := validateCanonicalOptions(lineEndings, trailingNewline); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validateCompareMode(compareMode); err != nil {
+		log.Fatal(err)
+	}
+	volatilePatterns, err := parseVolatilePatterns(ignorePatterns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validateEmptyPolicy(emptyPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateLabelConflictPolicy(labelConflict); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateSourceMode(sourceMode); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateEnvKeys(envKeys); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateMergeMode(mergeMode); err != nil {
+		log.Fatal(err)
+	}
+	if stagingName != "" && (outputDir != "" || targetResource != "") {
+		log.Fatal("--staging-name requires a config map target")
+	}
+	if listRetries < 0 || listBackoff <= 0 {
+		log.Fatal("--list-retries must not be negative and --list-backoff must be positive")
+	}
+	if changelogEntries < 0 {
+		log.Fatal("--changelog-entries must not be negative")
+	}
+	if maxValueBytes < 0 {
+		log.Fatal("--max-value-bytes must not be negative")
+	}
+	if memoryLimit < 0 {
+		log.Fatal("--memory-limit must not be negative")
+	}
+	setMemoryLimit(memoryLimit)
+	if stagingDir != "" && outputDir == "" {
+		log.Fatal("--staging-dir requires --output-dir")
+	}
+	if (stagingName != "" || stagingDir != "") && rulesFile != "" {
+		log.Fatal("staging can not be used with rules-file")
+	}
+	if (promoteAfter != 0 || promoteWebhookURL != "") && stagingName == "" && stagingDir == "" {
+		log.Fatal("--promote-after and --promote-webhook require --staging-name or --staging-dir")
+	}
+	if requireApproval && (outputDir != "" || targetResource != "") {
+		log.Fatal("--require-approval requires a config map target")
+	}
+	var freezeWindows []*freezeWindow
+	for _, spec := range freezeSpecs {
+		w, err := parseFreezeWindow(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		freezeWindows = append(freezeWindows, w)
+	}
+	if parts := strings.SplitN(freezeConfigMap, "/", 2); freezeConfigMap != "" && (len(parts) != 2 || parts[0] == "" || parts[1] == "") {
+		log.Fatalf("invalid freeze config map %q: expected <namespace>/<name>", freezeConfigMap)
+	}
+	var pauseMarkers []*pauseMarker
+	for _, spec := range pauseSpecs {
+		m, err := parsePauseMarker(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pauseMarkers = append(pauseMarkers, m)
+	}
+	var promote *webhook
+	if promoteWebhookURL != "" {
+		var err error
+		if promote, err = parseWebhook(promoteWebhookURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for name, command := range map[string]string{"check-command": checkCommand, "validate-cmd": validateCommand, "transform-command": transformCommand} {
+		if cmd.Flags().Changed(name) && strings.TrimSpace(command) == "" {
+			log.Fatalf("--%s must not be blank", name)
+		}
+	}
+	var validateCmd *template.Template
+	if validateCommand != "" {
+		var err error
+		if validateCmd, err = parseValidateCommand(validateCommand); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if checkCommand != "" && mergeMode == "" {
+		log.Fatal("--check-command requires --merge")
+	}
+	if mergeMode == mergeCorefile && (outputDir != "" || targetResource != "") {
+		log.Fatal("--merge=corefile requires a config map target")
+	}
+	for _, p := range targetKeys {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("invalid target key %q: %v", p, err)
+		}
+	}
+	for _, p := range significantKeys {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("invalid significant key %q: %v", p, err)
+		}
+	}
+	for _, p := range substituteEnv {
+		if _, err := path.Match(p, ""); err != nil {
+			log.Fatalf("invalid environment variable pattern %q: %v", p, err)
+		}
+	}
+	if len(targetKeys) > 0 && (outputDir != "" || targetResource != "") {
+		log.Fatal("--target-key requires a config map target")
+	}
+	if gitops && (outputDir != "" || targetResource != "" || mergeMode == mergeCorefile || len(targetKeys) > 0) {
+		log.Fatal("--gitops requires a config map target that is not merged with existing contents")
+	}
+	if documentKey != "" {
+		if err := validateKey(documentKey); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid document-key"))
+		}
+	}
+
+	if limitPolicy != limitPolicySkip && limitPolicy != limitPolicyFail {
+		log.Fatalf("invalid limit policy %q", limitPolicy)
+	}
+	if strict {
+		limitPolicy = limitPolicyFail
+	}
+
+	var validators []*keyValidator
+	for _, spec := range validateSpecs {
+		v, err := parseKeyValidator(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		validators = append(validators, v)
+	}
+
+	if len(waitForKeys) > 0 && !onetime {
+		log.Fatal("wait-for-keys can only be used with onetime")
 	}
 
-	if len(namespaces) == 0 {
-		namespaces = append(namespaces, "")
+	if instance != "" {
+		if err := validateLabelValue(instance); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid instance"))
+		}
 	}
-	c := &controller{
-		client:          newk8sClient(endpoint),
-		selector:        selector,
-		namespaces:      namespaces,
-		targetNamespace: args[0],
-		targetName:      args[1],
+
+	if archive != "" {
+		if _, err := archiveFormat(archive); err != nil {
+			log.Fatal(err)
+		}
+		if rulesFile != "" {
+			log.Fatal("archive can not be used with rules-file")
+		}
+	}
+
+	var owners []*ownerFilter
+	for _, spec := range ownerSpecs {
+		f, err := parseOwnerFilter(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		owners = append(owners, f)
 	}
 
-	log.Println("Starting configmap-aggregator...")
+	var after, before time.Time
+	if createdAfter != "" {
+		if after, err = time.Parse(time.RFC3339, createdAfter); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid created-after"))
+		}
+	}
+	if createdBefore != "" {
+		if before, err = time.Parse(time.RFC3339, createdBefore); err != nil {
+			log.Fatal(errors.Wrap(err, "invalid created-before"))
+		}
+	}
 
-	if err := c.client.waitForKubernetes(); err != nil {
+	targetLabels, err := parseLabels("target-label", targetLabelSpecs, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targetAnnotations, err := parseLabels("target-annotation", targetAnnotSpecs, false)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	if onetime {
-		if err := c.process(); err != nil {
+	var fileTypes []*fileType
+	for _, spec := range fileTypeSpecs {
+		ft, err := parseFileType(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileTypes = append(fileTypes, ft)
+	}
+
+	var gvr *groupVersionResource
+	var field []string
+	if targetResource != "" {
+		var err error
+		if gvr, err = parseGroupVersionResource(targetResource); err != nil {
+			log.Fatal(err)
+		}
+		if targetKind == "" {
+			log.Fatal("target-kind is required when target-resource is set")
+		}
+		if field, err = parseFieldPath(targetField); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var webhooks []*webhook
+	for _, spec := range webhookURLs {
+		w, err := parseWebhook(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	var unhealthyWebhook, healthyWebhook *webhook
+	if unhealthyURL != "" {
+		if unhealthyWebhook, err = parseWebhook(unhealthyURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if healthyURL != "" {
+		if healthyWebhook, err = parseWebhook(healthyURL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var webhookSecret []byte
+	if webhookSecretFile != "" {
+		data, err := ioutil.ReadFile(webhookSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhookSecret = bytes.TrimSpace(data)
+	}
+
+	client, err := newAPIClient(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newLister := func(client *k8sClient) ConfigMapLister {
+		return &configMapLister{client: client}
+	}
+	if sourceResource != "" {
+		gvr, err := parseGroupVersionResource(sourceResource)
+		if err != nil {
+			log.Fatal(err)
+		}
+		field, err := parseFieldPath(sourceField)
+		if err != nil {
 			log.Fatal(err)
 		}
+		newLister = func(client *k8sClient) ConfigMapLister {
+			return &resourceLister{client: client, resource: gvr, field: field}
+		}
+	}
+	if listRetries > 0 {
+		list := newLister
+		newLister = func(client *k8sClient) ConfigMapLister {
+			return &retryingLister{ConfigMapLister: list(client), retries: listRetries, backoff: listBackoff}
+		}
+	}
+	lister := newLister(client)
+	if len(fallbackEndpoints) > 0 {
+		fallback := &fallbackLister{ConfigMapLister: lister, endpoints: fallbackEndpoints}
+		for _, e := range fallbackEndpoints {
+			c, err := newAPIClient(e)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fallback.fallbacks = append(fallback.fallbacks, newLister(c))
+		}
+		lister = fallback
+	}
+	if len(sourceEndpoints) > 0 {
+		multi := &multiLister{listers: []namedLister{{lister: lister}}}
+		names := make(map[string]bool)
+		for _, s := range sourceEndpoints {
+			name, endpoint, opts, err := parseSourceEndpoint(s)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if names[name] {
+				log.Fatalf("duplicate source endpoint %s", name)
+			}
+			names[name] = true
+			c, err := newClient(endpoint, opts)
+			if err != nil {
+				log.Fatal(errors.Wrapf(err, "source endpoint %s", name))
+			}
+			multi.listers = append(multi.listers, namedLister{name: name, lister: newLister(c)})
+		}
+		lister = multi
+	}
+	if listCacheTTL > 0 {
+		lister = newCachingLister(lister, listCacheTTL)
+	}
+	var recorder *recordingLister
+	if snapshotFile != "" {
+		recorder = newRecordingLister(lister)
+		lister = recorder
+	}
+	if replayFile != "" {
+		if lister, err = loadSnapshot(replayFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var state *stateStore
+	if persistFile != "" {
+		if state, err = loadState(persistFile, shardSpec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var controllers []*controller
+	for _, r := range rules {
+		ruleNamespaces := r.Namespaces
+		if len(ruleNamespaces) == 0 {
+			ruleNamespaces = []string{""}
+		}
+		controllers = append(controllers, &controller{
+			client:                 client,
+			lister:                 lister,
+			trigger:                make(chan struct{}, 1),
+			name:                   r.Name,
+			status:                 &syncStatus{},
+			observed:               newObservedChanges(),
+			contributions:          newContributionCache(),
+			state:                  state,
+			syncInterval:           r.syncInterval,
+			schedule:               r.schedule,
+			selectors:              r.selectors,
+			namespaces:             ruleNamespaces,
+			namespaceSelector:      r.NamespaceSelector,
+			discoverNamespaces:     r.NamespaceSelector != "" || len(r.Namespaces) > 0,
+			listConcurrency:        listConcurrency,
+			compressThreshold:      compressThreshold,
+			lineEndings:            lineEndings,
+			trailingNewline:        trailingNewline,
+			compareMode:            compareMode,
+			volatilePatterns:       volatilePatterns,
+			emptyPolicy:            emptyPolicy,
+			minSources:             minSources,
+			maxRemovedFraction:     maxRemovedFraction,
+			verifyWrites:           verifyWrites,
+			verifyRetries:          verifyRetries,
+			webhooks:               webhooks,
+			significantKeys:        significantKeys,
+			webhookSecret:          webhookSecret,
+			webhookOnStart:         webhookOnStart,
+			unhealthyWebhook:       unhealthyWebhook,
+			healthyWebhook:         healthyWebhook,
+			unhealthyAfter:         unhealthyAfter,
+			targetNamespace:        r.TargetNamespace,
+			targetName:             r.TargetName,
+			targetLabels:           targetLabels,
+			targetAnnotations:      targetAnnotations,
+			propagateLabelPatterns: propagateLabels,
+			labelConflictPolicy:    labelConflict,
+			instance:               instance,
+			ruleID:                 r.id(),
+			shard:                  sh,
+			allowChained:           allowChained,
+			owners:                 owners,
+			recordSources:          recordSources,
+			sourceMode:             sourceMode,
+			documentKey:            documentKey,
+			envKeys:                envKeys,
+			mergeMode:              mergeMode,
+			mergeKey:               mergeKey,
+			checkCommand:           checkCommand,
+			gitops:                 gitops,
+			transformCommand:       transformCommand,
+			validateCommand:        validateCmd,
+			stagingName:            stagingName,
+			stagingDir:             stagingDir,
+			promoteAfter:           promoteAfter,
+			promoteWebhook:         promote,
+			requireApproval:        requireApproval,
+			freezeWindows:          freezeWindows,
+			freezeConfigMap:        freezeConfigMap,
+			pauseMarkers:           pauseMarkers,
+			notifyOnly:             notifyOnly,
+			dryRun:                 dryRun,
+			targetKeys:             targetKeys,
+			interpolation:          interpolation,
+			substituteEnv:          substituteEnv,
+			minAge:                 minAge,
+			createdAfter:           after,
+			createdBefore:          before,
+			coalesceWindow:         coalesceWindow,
+			minWriteInterval:       minWriteInterval,
+			maxSources:             maxSources,
+			maxKeys:                maxKeys,
+			maxBytes:               maxBytes,
+			limitPolicy:            limitPolicy,
+			memoryLimit:            memoryLimit,
+			namespaceMaxKeys:       namespaceMaxKeys,
+			namespaceMaxBytes:      namespaceMaxBytes,
+			strict:                 strict,
+			maxValueBytes:          maxValueBytes,
+			skipForbidden:          skipForbidden,
+			validators:             validators,
+			targetResource:         gvr,
+			targetKind:             targetKind,
+			targetField:            field,
+			outputDir:              r.OutputDir,
+			keyTemplate:            r.keyTemplate,
+			forceClean:             forceClean,
+			changelogEntries:       changelogEntries,
+			writeConcurrency:       writeConcurrency,
+			fileTypes:              fileTypes,
+			archive:                archive,
+		})
+	}
+
+	targets := make(map[string]bool)
+	for _, c := range controllers {
+		if c.targetName != "" {
+			targets[c.targetNamespace+"/"+c.targetName] = true
+		}
+		if c.stagingName != "" {
+			targets[c.targetNamespace+"/"+c.stagingName] = true
+		}
+		c.targets = targets
+	}
+	for _, c := range controllers {
+		c.restoreState()
+		// merging already keeps the keys others wrote to the target
+		if warmStart && !verify && !c.mergesExisting() && replayFile == "" {
+			c.warmUp()
+		}
+	}
+
+	for _, c := range controllers {
+		if c.outputDir == "" || verify || notifyOnly || dryRun {
+			continue
+		}
+		if err := c.claimOutputDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("Starting configmap-aggregator %s...", version)
+
+	if metricsAddress != "" {
+		serveHTTP(metricsAddress, controllers)
+	}
+
+	if replayFile != "" {
+		// there is no cluster to write to or wait for
+		for _, c := range controllers {
+			if c.namespaceSelector != "" {
+				log.Fatal("namespace-selector can not be used with replay")
+			}
+			if c.outputDir == "" && !dryRun {
+				log.Fatalf("%s: replay can only write to an output-dir or run with dry-run", c.name)
+			}
+		}
+	} else if err := client.waitForKubernetes(); err != nil {
+		log.Fatal(err)
+	}
+
+	if instance != "" && !verify && !notifyOnly && !dryRun && replayFile == "" {
+		if err := collectGarbage(client, instance, sh, controllers); err != nil {
+			log.Printf("failed to collect stale targets: %v", err)
+		}
+	}
+
+	if verify {
+		drifted := false
+		for _, c := range controllers {
+			changes, err := c.drift()
+			if err != nil {
+				log.Fatalf("failed to verify %s: %v", c.name, err)
+			}
+			for _, k := range changes.Added {
+				fmt.Printf("%s: missing %s\n", c.name, k)
+			}
+			for _, k := range changes.Modified {
+				fmt.Printf("%s: modified %s\n", c.name, k)
+			}
+			for _, k := range changes.Removed {
+				fmt.Printf("%s: unexpected %s\n", c.name, k)
+			}
+			if !changes.empty() {
+				drifted = true
+			}
+		}
+		if drifted {
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	var wg sync.WaitGroup
-	done := make(chan struct{})
+	if exportDir != "" {
+		if err := exportAggregates(exportDir, controllers); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
-	go func() {
-		wg.Add(1)
-		for {
-			if err := c.process(); err != nil {
-				log.Printf("failed to process config maps: %v", err)
+	if onetime {
+		failed := false
+		summary := &runSummary{}
+		start := time.Now()
+		for _, c := range controllers {
+			ruleStart := time.Now()
+			if len(waitForKeys) > 0 {
+				if err := c.waitForKeys(waitForKeys, waitTimeout); err != nil {
+					c.logf("%v", err)
+					failed = true
+					summary.Rules = append(summary.Rules, c.summarize(err, time.Since(ruleStart)))
+					continue
+				}
 			}
-			// TODO: info level?
-			//else {
-			//	log.Printf("configmap aggregation complete. Next sync in %v seconds.", syncInterval.Seconds())
-			//}
-			select {
-			case <-time.After(syncInterval):
-			case <-done:
-				wg.Done()
-				return
+			err := c.process()
+			if err != nil {
+				c.logf("failed to process config maps: %v", err)
+				failed = true
 			}
+			summary.Rules = append(summary.Rules, c.summarize(err, time.Since(ruleStart)))
 		}
-	}()
+		if recorder != nil {
+			if err := recorder.write(snapshotFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if summaryFile != "" {
+			summary.Success = !failed
+			summary.Duration = time.Since(start).Seconds()
+			if err := writeSummary(summaryFile, summary); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	for _, c := range controllers {
+		wg.Add(1)
+		go func(c *controller) {
+			defer wg.Done()
+			c.run(done)
+		}(c)
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
@@ -110,6 +1050,45 @@ func runAggregator(cmd *cobra.Command, args []string) {
 	os.Exit(0)
 }
 
+// run syncs until done is closed.
+func (c *controller) run(done <-chan struct{}) {
+	if c.discoverNamespaces {
+		go c.watchNamespaceLifecycle(done)
+	}
+	if c.outputDir != "" {
+		go c.watchOutputDir(done)
+	}
+
+	if watch {
+		c.watchLoop(done)
+		return
+	}
+	for {
+		if err := c.process(); err != nil {
+			c.logf("failed to process config maps: %v", err)
+		}
+		// TODO: info level?
+		//else {
+		//	log.Printf("configmap aggregation complete. Next sync in %v seconds.", syncInterval.Seconds())
+		//}
+		select {
+		case <-time.After(c.nextSync()):
+		case <-c.trigger:
+		case <-done:
+			return
+		}
+	}
+}
+
+// nextSync returns how long to wait until the next scheduled sync.
+func (c *controller) nextSync() time.Duration {
+	if c.schedule != nil {
+		now := time.Now()
+		return c.schedule.next(now).Sub(now)
+	}
+	return c.syncInterval
+}
+
 func hashConfigMap(cm *ConfigMap) string {
 	h := fnv.New64()
 	printer := spew.ConfigState{
@@ -121,6 +1100,9 @@ func hashConfigMap(cm *ConfigMap) string {
 
 	// we only hash the data for now
 	printer.Fprintf(h, "%#v", cm.Data)
+	if len(cm.BinaryData) > 0 {
+		printer.Fprintf(h, "%#v", cm.BinaryData)
+	}
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -130,64 +1112,438 @@ func compareConfigMaps(a, b *ConfigMap) bool {
 }
 
 func (c *controller) process() error {
+	err := c.sync()
+	c.notifyHealth(err)
+	if err != nil {
+		syncsTotal.add(1, "rule", c.name, "result", "failure")
+		return err
+	}
+	syncsTotal.add(1, "rule", c.name, "result", "success")
+	c.status.setReady()
+	return nil
+}
+
+// aggregate returns what should be written to the target. It returns nil
+// when the target should be kept as is.
+func (c *controller) aggregate() (*ConfigMap, error) {
 	cm, err := c.createConfigMap()
+	if err == errNoSources && c.emptyPolicy == emptyPolicyKeep {
+		c.logf("%v, keeping the existing target", err)
+		return nil, nil
+	}
 	if err != nil {
+		return nil, err
+	}
+	if c.outputDir != "" {
+		if err := c.mapFileTypes(cm); err != nil {
+			return nil, err
+		}
+	}
+	c.keepWarm(cm)
+	if c.outputDir == "" && c.targetResource == nil {
+		if err := c.compress(cm); err != nil {
+			return nil, err
+		}
+	}
+	return cm, nil
+}
+
+func (c *controller) sync() error {
+	c.lastChanges = nil
+	// changes observed after this are not covered by this sync
+	observed := c.observed.take()
+	written := false
+	defer func() {
+		if !written {
+			c.observed.restore(observed)
+		}
+	}()
+
+	defer c.saveState()
+
+	cm, err := c.aggregate()
+	if err != nil || cm == nil {
 		return err
 	}
-	return c.upsertConfigMap(cm)
+	if c.validateCommand != nil {
+		if err := c.validateOutput(cm); err != nil {
+			return err
+		}
+	}
+	if c.dryRun {
+		return c.previewChanges(cm)
+	}
+	if c.notifyOnly {
+		return c.notifyDrift(cm)
+	}
+	if len(c.freezeWindows) > 0 || c.freezeConfigMap != "" || len(c.pauseMarkers) > 0 {
+		if frozen, err := c.frozen(cm); err != nil || frozen {
+			return err
+		}
+	}
+	if c.requireApproval {
+		if ok, err := c.approved(cm); err != nil || !ok {
+			return err
+		}
+	}
+	if c.staged() {
+		if ok, err := c.stage(cm); err != nil || !ok {
+			return err
+		}
+	}
+	changes, err := c.writeTarget(cm)
+	if err != nil {
+		return err
+	}
+	hash := hashConfigMap(cm)
+	c.lastChanges = changes
+	c.promotedHash = c.stagedHash
+	written = true
+	c.propagated(observed, changes)
+	// the first successful sync can signal that the target is ready, unless
+	// it was already written before a restart
+	initial := c.webhookOnStart && !c.synced && !c.persisted.written(hash)
+	c.synced = true
+	if initial || !changes.empty() {
+		c.fireWebhooks(cm, changes, initial)
+	}
+	if c.persisted != nil {
+		c.persisted.Hash = hash
+		c.persisted.Sources = c.lastSourceVersions
+	}
+
+	// the archive is published until it succeeds, even if nothing changed since
+	if c.archive != "" && !c.archived && changes.empty() && c.persisted.archived(hash) {
+		c.archived = true
+	}
+	if c.archive != "" && (!changes.empty() || !c.archived) {
+		c.archived = false
+		if err := c.publishArchive(cm); err != nil {
+			return err
+		}
+		c.archived = true
+		if c.persisted != nil {
+			c.persisted.ArchivedHash = hash
+		}
+	}
+	return nil
 }
 
 func (c *controller) createConfigMap() (*ConfigMap, error) {
 	data := make(map[string]string)
+	var size aggregateSize
+	matched := 0
+	namespaceSize := make(map[string]aggregateSize)
+	labels := newPropagatedLabels()
+	versions := make(sourceVersions)
+	nested := make(nestedDocument)
+	order := make(mergeOrder)
+	entries := make(map[string][]string)
+	overLimit := make(map[string]bool)
+	now := time.Now().UTC().Truncate(time.Second)
 
-	for _, n := range c.namespaces {
-		list, err := c.client.getConfigMaps(n, selector)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get config maps for %s %s", n, c.selector)
+	namespaces, err := c.sourceNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	lists, err := c.listSources(namespaces)
+	if err != nil {
+		return nil, err
+	}
+	c.skippedNamespaces = 0
+	for _, list := range lists {
+		if list == nil {
+			c.skippedNamespaces++
+		}
+	}
+
+	// errors of single sources are collected so all of them are reported
+	var failed syncErrors
+	for _, list := range lists {
+		if list == nil {
+			continue
 		}
 
 	ITEMS:
 		for _, cm := range list.Items {
-			if cm.Metadata.Namespace == c.targetNamespace && cm.Metadata.Name == c.targetName {
+			if c.ownTarget(&cm) || !c.shard.owns(cm.Metadata.Namespace) {
+				continue ITEMS
+			}
+			if !c.ownedBy(&cm) || !c.inTimeRange(&cm) {
+				continue ITEMS
+			}
+			if cm.Metadata.Annotations["configmap-aggregator"] == "target" && !c.allowChained {
+				c.logf("skipping config map %s/%s: it is the target of another aggregator", cm.Metadata.Namespace, cm.Metadata.Name)
+				sourcesSkippedTotal.add(1, "rule", c.name, "reason", "chained")
+				continue ITEMS
+			}
+			matched++
+			nsSize := namespaceSize[cm.Metadata.Namespace]
+			if reason, err := c.checkLimits(&cm, size, nsSize); err != nil {
+				if c.limitPolicy == limitPolicyFail {
+					failed.add(errors.Wrapf(err, "config map %s/%s exceeds limit", cm.Metadata.Namespace, cm.Metadata.Name))
+					continue ITEMS
+				}
+				sourcesSkippedTotal.add(1, "rule", c.name, "reason", reason)
+				// only report sources that went over a limit since the
+				// last sync, rather than on every sync
+				key := contributionKey(&cm)
+				overLimit[key] = true
+				if !c.overLimit[key] {
+					c.logf("skipping config map %s/%s: %v", cm.Metadata.Namespace, cm.Metadata.Name, err)
+					c.recordEvent("Warning", "LimitExceeded", "skipped config map %s/%s: %v", cm.Metadata.Namespace, cm.Metadata.Name, err)
+				}
+				continue ITEMS
+			}
+			if err := c.propagateLabels(labels, &cm); err != nil {
+				failed.add(err)
 				continue ITEMS
 			}
-			for k, v := range cm.Data {
-				name := fmt.Sprintf("%s_%s_%s", cm.Metadata.Namespace, cm.Metadata.Name, k)
+			versions.add(&cm, now)
+			size.add(&cm)
+			nsSize.add(&cm)
+			namespaceSize[cm.Metadata.Namespace] = nsSize
+			contribution, err := c.contribution(&cm)
+			if err != nil {
+				failed.add(err)
+				continue ITEMS
+			}
+			for _, e := range contribution.entries {
+				name, v := e.name, e.value
+				check := validateKey
+				if c.outputDir != "" {
+					check = validatePath
+				}
+				n, err := c.envKey(name)
+				if err == nil {
+					name = n
+					err = check(name)
+				}
+				if err != nil {
+					failed.add(c.warn("skipping invalid key %q from %s/%s: %v", name, cm.Metadata.Namespace, cm.Metadata.Name, err))
+					continue
+				}
+				// values are validated again only when the source changed
+				if !contribution.valid[name] {
+					if err := c.validateValue(name, v); err != nil {
+						keysRejectedTotal.add(1, "rule", c.name, "reason", "validation")
+						c.recordEvent("Warning", "ValidationFailed", "rejected key %s from %s/%s: %v", name, cm.Metadata.Namespace, cm.Metadata.Name, err)
+						failed.add(c.warn("rejecting key %q from %s/%s: %v", name, cm.Metadata.Namespace, cm.Metadata.Name, err))
+						continue
+					}
+					contribution.valid[name] = true
+				}
+				if c.maxValueBytes > 0 && len(v) > c.maxValueBytes {
+					failed.add(c.warn("skipping key %q from %s/%s: value of %d bytes exceeds %d", name, cm.Metadata.Namespace, cm.Metadata.Name, len(v), c.maxValueBytes))
+					continue
+				}
+				if _, ok := data[name]; ok {
+					failed.add(c.warn("key %q from %s/%s conflicts with an existing key", name, cm.Metadata.Namespace, cm.Metadata.Name))
+					continue
+				}
 				data[name] = v
+				entries[contributionKey(&cm)] = append(entries[contributionKey(&cm)], name)
+				nested.add(c, &cm, e)
+				failed.add(order.add(c, &cm, name, e))
 			}
 		}
 	}
+	if err := failed.err(); err != nil {
+		return nil, err
+	}
+	c.contributions.prune()
+
+	if c.interpolation || len(c.substituteEnv) > 0 {
+		if data, err = c.interpolate(data); err != nil {
+			return nil, err
+		}
+	}
+	if c.documentKey != "" {
+		doc, err := json.MarshalIndent(nested, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode aggregate document")
+		}
+		data = map[string]string{c.documentKey: string(doc) + "\n"}
+	}
+	if data, err = c.merge(data, order); err != nil {
+		return nil, err
+	}
+	if c.transformCommand != "" {
+		if data, err = c.transform(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if matched == 0 && c.emptyPolicy != emptyPolicyEmpty {
+		return nil, errNoSources
+	}
+
+	if err := c.checkMinSources(size.sources); err != nil {
+		return nil, err
+	}
+	if err := c.checkMemory(); err != nil {
+		return nil, err
+	}
+
+	aggregateSources.set(float64(size.sources), "rule", c.name)
+	aggregateKeys.set(float64(size.keys), "rule", c.name)
+	aggregateBytes.set(float64(size.bytes), "rule", c.name)
+	c.lastSources = size.sources
+	c.lastKeys = size.keys
+	c.sourceKeys = sourceKeys(entries, data)
+	c.overLimit = overLimit
 
 	cm := newConfigMap(c.targetNamespace, c.targetName)
 	cm.Data = data
+	if propagated := labels.result(); len(propagated) > 0 {
+		for k, v := range propagated {
+			cm.Metadata.Labels[k] = v
+		}
+		cm.Metadata.Annotations[propagatedAnnotation] = strings.Join(sortedKeys(propagated), ",")
+	}
+	for k, v := range c.targetLabels {
+		cm.Metadata.Labels[k] = v
+	}
+	for k, v := range c.targetAnnotations {
+		cm.Metadata.Annotations[k] = v
+	}
+	cm.Metadata.Labels[ruleLabel] = c.ruleID
+	// targets managed by others must never be garbage collected
+	if c.instance != "" && !c.mergesExisting() {
+		cm.Metadata.Labels[instanceLabel] = c.instance
+		if c.shard != nil {
+			cm.Metadata.Labels[shardLabel] = strconv.Itoa(c.shard.index)
+		}
+	}
+	c.lastSourceVersions = versions.String()
+	if c.recordSources {
+		cm.Metadata.Annotations[sourcesAnnotation] = c.lastSourceVersions
+	}
 	cm.Metadata.Annotations["configmap-aggregator"] = "target"
+	cm.Metadata.Annotations["configmap-aggregator/version"] = version
 
 	return cm, nil
 }
 
-func (c *controller) upsertConfigMap(cm *ConfigMap) error {
+func (c *controller) upsertConfigMap(cm *ConfigMap) (*changeSet, error) {
+	if c.gitops {
+		return c.applyTarget(cm)
+	}
 	existing, err := c.client.getConfigMap(c.targetNamespace, c.targetName)
 	if err == ErrNotExist {
-		return c.client.createConfigMap(cm)
+		if err := c.mergeExisting(newConfigMap(c.targetNamespace, c.targetName), cm); err != nil {
+			return nil, err
+		}
+		if err := c.client.createConfigMap(cm); err != nil {
+			return nil, err
+		}
+		c.lastWrite = time.Now()
+		return c.diff(newConfigMap(c.targetNamespace, c.targetName), cm), nil
 	}
 	if err != nil {
-		return errors.Wrapf(err, "failed to get config map %s/%s", c.targetNamespace, c.targetName)
+		return nil, errors.Wrapf(err, "failed to get config map %s/%s", c.targetNamespace, c.targetName)
+	}
+
+	if err := c.checkOwner(existing.Metadata.Labels); err != nil {
+		return nil, err
+	}
+	if err := c.mergeExisting(existing, cm); err != nil {
+		return nil, err
 	}
 
-	//copy labels, annotations, and version
+	//copy labels, annotations, and version, except for labels propagated
+	// from sources that no longer have them
+	stale := staleLabels(existing, cm)
 	for k, v := range existing.Metadata.Annotations {
-		cm.Metadata.Annotations[k] = v
+		if _, ok := cm.Metadata.Annotations[k]; !ok && k != propagatedAnnotation {
+			cm.Metadata.Annotations[k] = v
+		}
 	}
 	for k, v := range existing.Metadata.Labels {
-		cm.Metadata.Labels[k] = v
+		if _, ok := cm.Metadata.Labels[k]; !ok && !stale[k] {
+			cm.Metadata.Labels[k] = v
+		}
 	}
 	cm.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	cm.Metadata.Annotations["configmap-aggregator/version"] = version
 
 	// XXX: unset fields on existing that will cause to not match
 	// currently we don't unmarshal any
 
-	if compareConfigMaps(existing, cm) {
-		return nil
+	changes := c.diff(existing, cm)
+	if changes.empty() {
+		return changes, nil
+	}
+	if err := c.checkRemoved(existing, cm); err != nil {
+		return nil, err
+	}
+
+	// only send the keys that changed. The resource version makes the
+	// patch fail if the target was modified since we read it.
+	data := dataPatch(existing.Data, cm.Data, c.valuesEqual)
+	binaryData := dataPatch(encodeBinaryData(existing.BinaryData), encodeBinaryData(cm.BinaryData), func(a, b string) bool {
+		return a == b
+	})
+	annotations := map[string]interface{}{
+		"configmap-aggregator/version": version,
+		compressedAnnotation:           nil,
+		propagatedAnnotation:           nil,
+	}
+	for k, v := range c.targetAnnotations {
+		annotations[k] = v
+	}
+	if c.requireApproval {
+		annotations[pendingAnnotation] = nil
+		annotations[pendingChangesAnnotation] = nil
+		annotations[approveAnnotation] = nil
+	}
+	// configured and propagated labels, along with the existing ones
+	labels := make(map[string]interface{}, len(cm.Metadata.Labels))
+	for k, v := range cm.Metadata.Labels {
+		labels[k] = v
+	}
+	for k := range stale {
+		labels[k] = nil
+	}
+	if v, ok := cm.Metadata.Annotations[propagatedAnnotation]; ok {
+		annotations[propagatedAnnotation] = v
+	}
+	if v, ok := cm.Metadata.Annotations[sourcesAnnotation]; ok && c.recordSources {
+		annotations[sourcesAnnotation] = v
+	}
+	if v, ok := cm.Metadata.Annotations[compressedAnnotation]; ok && len(cm.BinaryData) > 0 {
+		annotations[compressedAnnotation] = v
+	}
+	if c.mergesExisting() {
+		// others write to the target too, so rather than failing on any
+		// change to the resource version, only check the keys being changed
+		var ops []jsonPatchOp
+		ops = append(ops, fieldPatch("/data", existing.Data, data)...)
+		ops = append(ops, fieldPatch("/binaryData", encodeBinaryData(existing.BinaryData), binaryData)...)
+		ops = append(ops, fieldPatch("/metadata/annotations", existing.Metadata.Annotations, annotations)...)
+		ops = append(ops, fieldPatch("/metadata/labels", existing.Metadata.Labels, labels)...)
+		if err := c.client.patchConfigMap(c.targetNamespace, c.targetName, jsonPatchType, ops); err != nil {
+			return nil, err
+		}
+		c.logf("updated %d keys in %s/%s", len(data)+len(binaryData), c.targetNamespace, c.targetName)
+		c.lastWrite = time.Now()
+		return changes, nil
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": existing.Metadata.ResourceVersion,
+			"annotations":     annotations,
+			"labels":          labels,
+		},
+		"data":       data,
+		"binaryData": binaryData,
+	}
+	if err := c.client.patchConfigMap(c.targetNamespace, c.targetName, mergePatchType, patch); err != nil {
+		return nil, err
 	}
-	return c.client.updateConfigMap(cm)
+	c.logf("updated %d keys in %s/%s", len(data)+len(binaryData), c.targetNamespace, c.targetName)
+	c.lastWrite = time.Now()
+	return changes, nil
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest [target-namespace] [target-name] | manifest [namespace] --rules-file=...",
+	Short: "print a deployment that runs the aggregator with the current flags",
+	Run:   runManifest,
+}
+
+var image, proxyImage string
+
+// flags that only make sense when running locally. The deployment talks to
+// the API server through the proxy sidecar, so credentials for an endpoint
+// are not needed.
+var manifestSkipFlags = map[string]bool{
+	"endpoint":        true,
+	"onetime":         true,
+	"rules-file":      true,
+	"token-file":      true,
+	"ca-file":         true,
+	"exec-credential": true,
+}
+
+// flags taking a webhook with options, some of which name files
+var manifestWebhookFlags = map[string]bool{
+	"webhook":           true,
+	"promote-webhook":   true,
+	"unhealthy-webhook": true,
+	"healthy-webhook":   true,
+}
+
+var webhookFileOptions = map[string]bool{
+	"bearer-token-file": true,
+	"basic-auth-file":   true,
+	"ca-file":           true,
+	"cert-file":         true,
+	"key-file":          true,
+}
+
+const (
+	rulesMountPath = "/etc/configmap-aggregator"
+	filesMountPath = "/etc/configmap-aggregator-files"
+)
+
+// manifestFiles collects the local files named by flags, so they can be
+// mounted into the deployment from a secret, as some of them hold
+// credentials.
+type manifestFiles struct {
+	keys map[string]string
+	// base64 encoded contents by secret key
+	data map[string]string
+}
+
+func newManifestFiles() *manifestFiles {
+	return &manifestFiles{keys: make(map[string]string), data: make(map[string]string)}
+}
+
+// mount returns the path the file at path is mounted at.
+func (m *manifestFiles) mount(path string) string {
+	key, ok := m.keys[path]
+	if !ok {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = fmt.Sprintf("%d-%s", len(m.keys), filepath.Base(path))
+		if err := validateKey(key); err != nil {
+			log.Fatal(errors.Wrapf(err, "can not mount %s", path))
+		}
+		m.keys[path] = key
+		m.data[key] = base64.StdEncoding.EncodeToString(data)
+	}
+	return filesMountPath + "/" + key
+}
+
+// rewrite replaces the local files named in the value of a flag with the
+// paths they are mounted at.
+func (m *manifestFiles) rewrite(name, value string) string {
+	switch {
+	case name == "webhook-secret-file":
+		return m.mount(value)
+	case name == "validate":
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || builtinValidators[parts[1]] != nil ||
+			strings.HasPrefix(parts[1], "http://") || strings.HasPrefix(parts[1], "https://") {
+			return value
+		}
+		return parts[0] + "=" + m.mount(parts[1])
+	case manifestWebhookFlags[name]:
+		parts := strings.Fields(value)
+		for i := 1; i < len(parts); i++ {
+			kv := strings.SplitN(parts[i], "=", 2)
+			if len(kv) == 2 && webhookFileOptions[kv[0]] {
+				parts[i] = kv[0] + "=" + m.mount(kv[1])
+			}
+		}
+		return strings.Join(parts, " ")
+	}
+	return value
+}
+
+type manifestConfig struct {
+	Name            string
+	ServiceAccount  string
+	TargetNamespace string
+	Image           string
+	ProxyImage      string
+	Args            []string
+	// contents of the rules file, mounted from a config map
+	Rules string
+	// files named by flags, mounted from a secret
+	Files map[string]string
+	// port serving /readyz, if any
+	ProbePort string
+	// identify what the deployment writes
+	Instance string
+	Rule     string
+	// expose pod metadata as environment variables for substitution
+	DownwardAPI bool
+}
+
+var manifestTemplate = template.Must(template.New("manifest").Funcs(template.FuncMap{
+	"quote": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	},
+}).Parse(`---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{.ServiceAccount}}
+  namespace: {{.TargetNamespace}}
+{{- if .Rules}}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{.Name}}-rules
+  namespace: {{.TargetNamespace}}
+data:
+  rules.json: {{quote .Rules}}
+{{- end}}
+{{- if .Files}}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}-files
+  namespace: {{.TargetNamespace}}
+data:
+{{- range $k, $v := .Files}}
+  {{$k}}: {{$v}}
+{{- end}}
+{{- end}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Name}}
+  namespace: {{.TargetNamespace}}
+  labels:
+    app: {{.Name}}
+{{- if .Instance}}
+    configmap-aggregator/instance: {{quote .Instance}}
+{{- end}}
+{{- if .Rule}}
+    configmap-aggregator/rule: {{quote .Rule}}
+{{- end}}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app: {{.Name}}
+    spec:
+      serviceAccountName: {{.ServiceAccount}}
+      containers:
+      - name: configmap-aggregator
+        image: {{quote .Image}}
+        args:
+{{- range .Args}}
+        - {{quote .}}
+{{- end}}
+{{- if .DownwardAPI}}
+        env:
+        - name: POD_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.name
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
+        - name: NODE_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: spec.nodeName
+{{- end}}
+        resources:
+          requests:
+            cpu: 10m
+            memory: 32Mi
+{{- if .ProbePort}}
+        readinessProbe:
+          httpGet:
+            path: /readyz
+            port: {{.ProbePort}}
+{{- end}}
+{{- if or .Rules .Files}}
+        volumeMounts:
+{{- if .Rules}}
+        - name: rules
+          mountPath: ` + rulesMountPath + `
+{{- end}}
+{{- if .Files}}
+        - name: files
+          mountPath: ` + filesMountPath + `
+          readOnly: true
+{{- end}}
+{{- end}}
+      - name: kubectl-proxy
+        image: {{quote .ProxyImage}}
+        command: ["kubectl", "proxy", "--port=8001"]
+        resources:
+          requests:
+            cpu: 10m
+            memory: 32Mi
+{{- if or .Rules .Files}}
+      volumes:
+{{- if .Rules}}
+      - name: rules
+        configMap:
+          name: {{.Name}}-rules
+{{- end}}
+{{- if .Files}}
+      - name: files
+        secret:
+          secretName: {{.Name}}-files
+{{- end}}
+{{- end}}
+`))
+
+// manifestArgs returns the aggregator flags that were explicitly set, with
+// the files they name mounted.
+func manifestArgs(flags *pflag.FlagSet, files *manifestFiles) []string {
+	var args []string
+	flags.Visit(func(f *pflag.Flag) {
+		if manifestSkipFlags[f.Name] || rootCmd.PersistentFlags().Lookup(f.Name) == nil {
+			return
+		}
+		var values []string
+		switch f.Value.Type() {
+		case "stringArray":
+			values, _ = flags.GetStringArray(f.Name)
+		case "stringSlice":
+			values, _ = flags.GetStringSlice(f.Name)
+		default:
+			values = []string{f.Value.String()}
+		}
+		for _, v := range values {
+			args = append(args, "--"+f.Name+"="+files.rewrite(f.Name, v))
+		}
+	})
+	return args
+}
+
+func runManifest(cmd *cobra.Command, args []string) {
+	rules, namespace, err := rulesFromArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if namespace == "" {
+		log.Fatal("namespace of the deployment is required")
+	}
+
+	files := newManifestFiles()
+	flagArgs := manifestArgs(cmd.Flags(), files)
+	m := &manifestConfig{
+		Name:            "configmap-aggregator-" + rules[0].TargetName,
+		ServiceAccount:  serviceAccount,
+		TargetNamespace: namespace,
+		Image:           image,
+		ProxyImage:      proxyImage,
+		Args:            append(flagArgs, args...),
+		Files:           files.data,
+		Instance:        instance,
+		Rule:            rules[0].id(),
+		DownwardAPI:     len(substituteEnv) > 0,
+	}
+
+	if metricsAddress != "" {
+		if _, port, err := net.SplitHostPort(metricsAddress); err == nil {
+			m.ProbePort = port
+		}
+	}
+
+	if rulesFile != "" {
+		data, err := ioutil.ReadFile(rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m.Name = "configmap-aggregator"
+		m.Rule = ""
+		m.Rules = string(data)
+		m.Args = append(flagArgs, "--rules-file="+rulesMountPath+"/rules.json")
+	}
+
+	if err := manifestTemplate.Execute(os.Stdout, m); err != nil {
+		log.Fatal(err)
+	}
+}
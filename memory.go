@@ -0,0 +1,35 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+)
+
+// setMemoryLimit makes the garbage collector work harder as the heap
+// approaches limit, rather than letting garbage push the process over the
+// memory limit of its container.
+func setMemoryLimit(limit int) {
+	if limit > 0 {
+		debug.SetMemoryLimit(int64(limit))
+	}
+}
+
+// checkMemory fails the sync when the live heap, with the sources and the
+// aggregate built, is over the memory limit, so the target is left as it is
+// instead of the process running out of memory while writing it. The heap
+// is collected first so garbage does not count, which costs a collection
+// per sync.
+func (c *controller) checkMemory() error {
+	if c.memoryLimit <= 0 {
+		return nil
+	}
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > uint64(c.memoryLimit) {
+		return errors.Errorf("aggregate needs %d bytes of memory, more than the memory limit of %d", m.HeapAlloc, c.memoryLimit)
+	}
+	return nil
+}
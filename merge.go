@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// merge modes combine every aggregated value into a single key
+const (
+	// deep merge YAML or JSON objects into Helm values
+	mergeHelmValues = "helm-values"
+	// concatenate Prometheus rule groups
+	mergePrometheusRules = "prometheus-rules"
+	// concatenate Prometheus scrape configs
+	mergePrometheusScrapeConfigs = "prometheus-scrape-configs"
+	// concatenate values in key order
+	mergeConcat = "concat"
+	// group fluent-bit sections by kind
+	mergeFluentBit = "fluent-bit"
+	// add CoreDNS server blocks to an existing Corefile
+	mergeCorefile = "corefile"
+)
+
+// defaultMergeKeys are the keys merged values are written to, by mode.
+var defaultMergeKeys = map[string]string{
+	mergeHelmValues:              "values.yaml",
+	mergePrometheusRules:         "rules.yaml",
+	mergePrometheusScrapeConfigs: "scrape-configs.yaml",
+	mergeConcat:                  "merged.conf",
+	mergeFluentBit:               "fluent-bit.conf",
+	mergeCorefile:                "Corefile",
+}
+
+func validateMergeMode(mode string) error {
+	if _, ok := defaultMergeKeys[mode]; ok || mode == "" {
+		return nil
+	}
+	return errors.Errorf("invalid merge mode %q", mode)
+}
+
+// deepMerge merges src into dst. Objects are merged recursively, anything
+// else in src replaces what is in dst, as Helm does with values files.
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		s, ok := v.(map[string]interface{})
+		d, dok := dst[k].(map[string]interface{})
+		if ok && dok {
+			deepMerge(d, s)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// mergeHelm deep merges each value, in order, into a values file.
+func (c *controller) mergeHelm(keys []string, data map[string]string) (string, error) {
+	values := make(map[string]interface{})
+	for _, k := range keys {
+		v, err := parseYAMLDocument(data[k])
+		if err != nil {
+			if err := c.warn("skipping values fragment %s: %v", k, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			if err := c.warn("skipping values fragment %s: not an object", k); err != nil {
+				return "", err
+			}
+			continue
+		}
+		deepMerge(values, m)
+	}
+	return toYAML(values), nil
+}
+
+// concat joins values in order, each ending in a newline.
+func concat(keys []string, data map[string]string) string {
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(data[k])
+		if v := data[k]; v != "" && !strings.HasSuffix(v, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// merge combines the aggregate into a single key according to the merge
+// mode, taking values in merge order.
+func (c *controller) merge(data map[string]string, order mergeOrder) (map[string]string, error) {
+	key := c.mergeKey
+	if key == "" {
+		key = defaultMergeKeys[c.mergeMode]
+	}
+
+	keys := order.keys(data)
+	var merged string
+	var err error
+	switch c.mergeMode {
+	case mergeHelmValues:
+		merged, err = c.mergeHelm(keys, data)
+	case mergePrometheusRules:
+		merged, err = c.mergeList(prometheusRules, keys, data)
+	case mergePrometheusScrapeConfigs:
+		merged, err = c.mergeList(prometheusScrapeConfigs, keys, data)
+	case mergeConcat:
+		merged = concat(keys, data)
+	case mergeFluentBit:
+		merged, err = c.mergeFluentBit(keys, data)
+	case mergeCorefile:
+		merged, err = c.mergeCorefile(keys, data)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.checkCommand != "" {
+		if err := c.checkValue(key, merged); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]string{key: merged}, nil
+}
+
+// mergesExisting reports whether the target is managed by others, and only
+// partly written by the aggregator.
+func (c *controller) mergesExisting() bool {
+	return c.mergeMode == mergeCorefile || len(c.targetKeys) > 0
+}
+
+// mergeExisting merges cm into existing contents of the target that are
+// managed by others. With target keys, only keys matching them are written
+// and other keys of the target are kept. In corefile mode, the merged key is
+// spliced into the existing value and every other key of the target is kept.
+func (c *controller) mergeExisting(existing, cm *ConfigMap) error {
+	if !c.mergesExisting() {
+		return nil
+	}
+	managed := func(k string) bool {
+		return matchAny(c.targetKeys, k)
+	}
+	if len(c.targetKeys) > 0 {
+		for k := range cm.Data {
+			if !managed(k) {
+				delete(cm.Data, k)
+			}
+		}
+		for k := range cm.BinaryData {
+			if !managed(k) {
+				delete(cm.BinaryData, k)
+			}
+		}
+	}
+	if c.mergeMode == mergeCorefile {
+		for k := range cm.Data {
+			v, err := c.spliceCorefile(existing.Data[k])
+			if err != nil {
+				return err
+			}
+			cm.Data[k] = v
+		}
+	}
+
+	for k, v := range existing.Data {
+		if _, ok := cm.Data[k]; !ok && !managed(k) {
+			cm.Data[k] = v
+		}
+	}
+	for k, v := range existing.BinaryData {
+		if _, ok := cm.BinaryData[k]; !ok && !managed(k) {
+			if cm.BinaryData == nil {
+				cm.BinaryData = make(map[string][]byte)
+			}
+			cm.BinaryData[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a tiny registry that renders the prometheus text format. We only need a
+// handful of counters and gauges, so this avoids pulling in the client library.
+var (
+	metricsMu sync.Mutex
+	registry  []*metric
+)
+
+var (
+	syncsTotal = newMetric("counter", "configmap_aggregator_syncs_total",
+		"Number of syncs by result.")
+	sourcesSkippedTotal = newMetric("counter", "configmap_aggregator_sources_skipped_total",
+		"Number of source config maps skipped by reason.")
+	keysRejectedTotal = newMetric("counter", "configmap_aggregator_keys_rejected_total",
+		"Number of source keys rejected by reason.")
+	safetyBreachesTotal = newMetric("counter", "configmap_aggregator_safety_breaches_total",
+		"Number of times an update was refused by a safety threshold.")
+	verifyFailuresTotal = newMetric("counter", "configmap_aggregator_verify_failures_total",
+		"Number of writes whose read back did not match the aggregate.")
+	webhooksTotal = newMetric("counter", "configmap_aggregator_webhooks_total",
+		"Number of webhook calls by result.")
+	aggregateSources = newMetric("gauge", "configmap_aggregator_sources",
+		"Number of source config maps in the last aggregate.")
+	aggregateKeys = newMetric("gauge", "configmap_aggregator_keys",
+		"Number of keys in the last aggregate.")
+	aggregateBytes = newMetric("gauge", "configmap_aggregator_bytes",
+		"Size in bytes of the values in the last aggregate.")
+	frozenChanges = newMetric("gauge", "configmap_aggregator_frozen_changes",
+		"Number of keys of the target held back by a change freeze.")
+	driftedKeys = newMetric("gauge", "configmap_aggregator_drifted_keys",
+		"Number of keys of the target that differ from the aggregate in notify only mode.")
+	propagationDelay = newHistogram("configmap_aggregator_propagation_delay_seconds",
+		"Delay between a watch observing a change to a source and the change reaching the target.",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 300, 900})
+)
+
+type metric struct {
+	kind   string
+	name   string
+	help   string
+	values map[string]float64
+	// upper bounds of the buckets of a histogram
+	buckets []float64
+}
+
+func newMetric(kind, name, help string) *metric {
+	m := &metric{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		values: make(map[string]float64),
+	}
+	metricsMu.Lock()
+	registry = append(registry, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newHistogram(name, help string, buckets []float64) *metric {
+	m := newMetric("histogram", name, help)
+	m.buckets = buckets
+	return m
+}
+
+// labels are passed as name, value pairs
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) add(v float64, labels ...string) {
+	metricsMu.Lock()
+	m.values[labelString(labels)] += v
+	metricsMu.Unlock()
+}
+
+func (m *metric) set(v float64, labels ...string) {
+	metricsMu.Lock()
+	m.values[labelString(labels)] = v
+	metricsMu.Unlock()
+}
+
+// observe adds a value to a histogram. Values are stored under their full
+// series names, such as _bucket{le="1"}, so they are written like any other.
+func (m *metric) observe(v float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, b := range m.buckets {
+		// every bucket is written, even if empty
+		k := "_bucket" + labelString(append(labels, "le", fmt.Sprint(b)))
+		m.values[k] += 0
+		if v <= b {
+			m.values[k]++
+		}
+	}
+	m.values["_bucket"+labelString(append(labels, "le", "+Inf"))]++
+	m.values["_sum"+labelString(labels)] += v
+	m.values["_count"+labelString(labels)]++
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registry {
+		if len(m.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %v\n", m.name, k, m.values[k])
+		}
+	}
+}
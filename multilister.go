@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// sourceAnnotation is set on config maps listed from an additional source
+// to the name of that source.
+const sourceAnnotation = "configmap-aggregator/source"
+
+type namedLister struct {
+	name   string
+	lister ConfigMapLister
+}
+
+// multiLister lists from several listers, such as the API servers of other
+// clusters, and merges the results. Config maps from named listers are
+// annotated with the name so they can be told apart.
+type multiLister struct {
+	listers []namedLister
+}
+
+// wrap names the source in errors of additional sources. Errors of the
+// primary source are returned as is, so ErrForbidden can be detected.
+func (n *namedLister) wrap(err error, msg string) error {
+	if n.name == "" {
+		return err
+	}
+	return errors.Wrapf(err, "%s source %s", msg, n.name)
+}
+
+// parseSourceEndpoint parses <name>=<endpoint>, optionally followed by the
+// credentials of the endpoint, such as "token-file=/path ca-file=/path".
+// exec-credential takes the rest of the spec, so it must come last.
+func parseSourceEndpoint(s string) (string, string, clientOptions, error) {
+	var opts clientOptions
+	parts := strings.Fields(s)
+	if len(parts) == 0 {
+		return "", "", opts, errors.New("empty source endpoint")
+	}
+	kv := strings.SplitN(parts[0], "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return "", "", opts, errors.Errorf("invalid source endpoint %q: expected <name>=<endpoint>", s)
+	}
+	if err := validateKey(kv[0]); err != nil || kv[0] == "" {
+		return "", "", opts, errors.Errorf("invalid source name %q", kv[0])
+	}
+	name, endpoint := kv[0], kv[1]
+	for i, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return "", "", opts, errors.Errorf("invalid source endpoint option %q: expected <name>=<value>", opt)
+		}
+		switch kv[0] {
+		case "token-file":
+			opts.tokenFile = kv[1]
+		case "ca-file":
+			opts.caFile = kv[1]
+		case "cert-file":
+			opts.certFile = kv[1]
+		case "key-file":
+			opts.keyFile = kv[1]
+		case "exec-credential":
+			opts.execCredential = strings.Join(append([]string{kv[1]}, parts[i+2:]...), " ")
+			return name, endpoint, opts, nil
+		default:
+			return "", "", opts, errors.Errorf("unknown source endpoint option %q", kv[0])
+		}
+	}
+	return name, endpoint, opts, nil
+}
+
+func label(name string, cm *ConfigMap) {
+	if name == "" {
+		return
+	}
+	if cm.Metadata.Annotations == nil {
+		cm.Metadata.Annotations = make(map[string]string)
+	}
+	cm.Metadata.Annotations[sourceAnnotation] = name
+}
+
+func (l *multiLister) List(namespace, selector string) (*ConfigMapList, error) {
+	var all ConfigMapList
+	for _, n := range l.listers {
+		list, err := n.lister.List(namespace, selector)
+		if err != nil {
+			return nil, n.wrap(err, "failed to list")
+		}
+		for i := range list.Items {
+			label(n.name, &list.Items[i])
+		}
+		all.Items = append(all.Items, list.Items...)
+	}
+	return &all, nil
+}
+
+// watch watches all listers until one of them returns, so they are restarted
+// together, and returns the first error.
+func (l *multiLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	var watchers []watcher
+	for _, n := range l.listers {
+		w, ok := n.lister.(watcher)
+		if !ok {
+			return errors.New("source does not support watching")
+		}
+		watchers = append(watchers, w)
+	}
+
+	stop := make(chan struct{})
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		once sync.Once
+		errs []error
+	)
+	for i, w := range watchers {
+		wg.Add(1)
+		go func(i int, name string, w watcher) {
+			defer wg.Done()
+			defer once.Do(func() { close(stop) })
+			err := w.watch(namespace, selector, stop, func(e WatchEvent) {
+				label(name, &e.Object)
+				mu.Lock()
+				defer mu.Unlock()
+				fn(e)
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, l.listers[i].wrap(err, "failed to watch"))
+				mu.Unlock()
+			}
+		}(i, l.listers[i].name, w)
+	}
+	go func() {
+		select {
+		case <-done:
+			once.Do(func() { close(stop) })
+		case <-stop:
+		}
+	}()
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
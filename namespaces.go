@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Namespace struct {
+	Metadata Metadata `json:"metadata"`
+}
+
+type NamespaceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []Namespace `json:"items"`
+}
+
+func (k *k8sClient) getNamespaces(selector string) (*NamespaceList, error) {
+	query := url.Values{}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	resp, err := k.client.Get(k.endpoint + "/api/v1/namespaces?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error listing namespaces; got HTTP %v status code", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var nl NamespaceList
+	if err := json.Unmarshal(data, &nl); err != nil {
+		return nil, err
+	}
+	return &nl, nil
+}
+
+// watchNamespaces streams namespace events that happened after resourceVersion.
+func (k *k8sClient) watchNamespaces(selector, resourceVersion string, done <-chan struct{}, fn func(eventType string, ns Namespace)) error {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	return k.watch(k.endpoint+"/api/v1/namespaces?"+query.Encode(), done, func(e rawWatchEvent) error {
+		var ns Namespace
+		if err := json.Unmarshal(e.Object, &ns); err != nil {
+			return err
+		}
+		fn(e.Type, ns)
+		return nil
+	})
+}
+
+// sourceNamespaces returns the namespaces to search, discovering them by
+// label if a namespace selector is set.
+func (c *controller) sourceNamespaces() ([]string, error) {
+	if c.namespaceSelector == "" {
+		var names []string
+		for _, n := range c.namespaces {
+			// all namespaces are listed at once and filtered afterwards
+			if n == "" || c.shard.owns(n) {
+				names = append(names, n)
+			}
+		}
+		return names, nil
+	}
+
+	list, err := c.client.getNamespaces(c.namespaceSelector)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get namespaces for %s", c.namespaceSelector)
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, ns := range list.Items {
+		if c.shard.owns(ns.Metadata.Name) {
+			names = append(names, ns.Metadata.Name)
+		}
+	}
+	return names, nil
+}
+
+// listNamespace lists the sources in a namespace matching any selector.
+// Kubernetes selectors can not express OR, so each is listed separately and
+// the results are merged.
+func (c *controller) listNamespace(namespace string) (*ConfigMapList, error) {
+	if len(c.selectors) <= 1 {
+		return c.lister.List(namespace, strings.Join(c.selectors, ""))
+	}
+
+	merged := &ConfigMapList{}
+	seen := make(map[string]bool)
+	for _, s := range c.selectors {
+		list, err := c.lister.List(namespace, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, cm := range list.Items {
+			key := cm.Metadata.Namespace + "/" + cm.Metadata.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged.Items = append(merged.Items, cm)
+		}
+	}
+	sort.Slice(merged.Items, func(i, j int) bool {
+		a, b := merged.Items[i].Metadata, merged.Items[j].Metadata
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return merged, nil
+}
+
+// listQueued lists namespace, or in watch mode returns its last list if it
+// did not change since. When listing fails in watch mode, the last list is
+// used and the namespace is retried with backoff.
+func (c *controller) listQueued(namespace string) (*ConfigMapList, error) {
+	if c.queue == nil {
+		return c.listNamespace(namespace)
+	}
+	if list, ok := c.queue.next(namespace); ok {
+		return list, nil
+	}
+	list, err := c.listNamespace(namespace)
+	if err == nil {
+		c.queue.done(namespace, list)
+		return list, nil
+	}
+	// a forbidden namespace must not keep contributing its last list
+	if err == ErrForbidden {
+		return nil, err
+	}
+	last, retry, ok := c.queue.failed(namespace)
+	if !ok {
+		return nil, err
+	}
+	c.logf("failed to list namespace %q, using its last list and retrying in %v: %v", namespace, retry, err)
+	time.AfterFunc(retry, c.notify)
+	return last, nil
+}
+
+// listSources lists the sources in each namespace, with at most
+// listConcurrency requests in flight so a cold start in a large cluster
+// does not overwhelm the API server. The results are in the same order as
+// namespaces, with nil for namespaces that were skipped.
+func (c *controller) listSources(namespaces []string) ([]*ConfigMapList, error) {
+	lists := make([]*ConfigMapList, len(namespaces))
+	errs := make([]error, len(namespaces))
+
+	concurrency := c.listConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := 0
+	for i, n := range namespaces {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, n string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			lists[i], errs[i] = c.listQueued(n)
+
+			mu.Lock()
+			done++
+			if c.status.progress(done, len(namespaces)) && (done == len(namespaces) || done%10 == 0) {
+				c.logf("initial sync listed %d/%d namespaces", done, len(namespaces))
+			}
+			mu.Unlock()
+		}(i, n)
+	}
+	wg.Wait()
+
+	var failed syncErrors
+	for i, err := range errs {
+		// a forbidden namespace must not silently empty the target, so it is
+		// only skipped when asked to
+		if err == ErrForbidden && c.skipForbidden {
+			failed.add(c.warn("skipping namespace %q: %v", namespaces[i], err))
+			lists[i] = nil
+			continue
+		}
+		if err != nil {
+			failed.add(errors.Wrapf(err, "failed to get config maps for %s %s", namespaces[i], strings.Join(c.selectors, " or ")))
+		}
+	}
+	if err := failed.err(); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// notify requests a sync as soon as possible.
+func (c *controller) notify() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// watchNamespaceLifecycle triggers a sync when a source namespace is created
+// or deleted, so new namespaces are picked up and the keys of deleted ones
+// are pruned without waiting for the next interval.
+func (c *controller) watchNamespaceLifecycle(done <-chan struct{}) {
+	explicit := make(map[string]bool)
+	if c.namespaceSelector == "" {
+		for _, n := range c.namespaces {
+			explicit[n] = true
+		}
+	}
+
+	for {
+		err := func() error {
+			list, err := c.client.getNamespaces(c.namespaceSelector)
+			if err != nil {
+				return err
+			}
+			return c.client.watchNamespaces(c.namespaceSelector, list.Metadata.ResourceVersion, done, func(eventType string, ns Namespace) {
+				if eventType != "ADDED" && eventType != "DELETED" {
+					return
+				}
+				if len(explicit) > 0 && !explicit[ns.Metadata.Name] {
+					return
+				}
+				c.logf("namespace %s %s, syncing", ns.Metadata.Name, eventType)
+				c.notify()
+			})
+		}()
+		if err != nil {
+			c.logf("failed to watch namespaces: %v", err)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
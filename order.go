@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// orderAnnotation on a source sets the position of its values when they are
+// merged. orderAnnotation + "." + key overrides it for a single key.
+const orderAnnotation = "configmap-aggregator/order"
+
+// orderIndex is the position of an aggregated key in the merge order.
+type orderIndex struct {
+	order     int
+	namespace string
+	name      string
+	key       string
+}
+
+// mergeOrder holds the position of each aggregated key.
+type mergeOrder map[string]orderIndex
+
+// add records the position of an entry of cm, added to the aggregate as name.
+func (o mergeOrder) add(c *controller, cm *ConfigMap, name string, e sourceEntry) error {
+	i := orderIndex{namespace: cm.Metadata.Namespace, name: cm.Metadata.Name, key: e.key}
+	annotation := orderAnnotation
+	v, ok := cm.Metadata.Annotations[annotation]
+	if e.key != "" {
+		if kv, kok := cm.Metadata.Annotations[orderAnnotation+"."+e.key]; kok {
+			annotation, v, ok = orderAnnotation+"."+e.key, kv, kok
+		}
+	}
+	if ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			if err := c.warn("ignoring %s %q of %s/%s: not an integer", annotation, v, cm.Metadata.Namespace, cm.Metadata.Name); err != nil {
+				return err
+			}
+		}
+		i.order = n
+	}
+	o[name] = i
+	return nil
+}
+
+// keys returns the keys of data in merge order: by order, which is 0 unless
+// annotated, then by namespace, name, and key of the source. Keys without a
+// position, such as a document key, sort by name.
+func (o mergeOrder) keys(data map[string]string) []string {
+	keys := sortedKeys(data)
+	sort.SliceStable(keys, func(a, b int) bool {
+		x, y := o[keys[a]], o[keys[b]]
+		switch {
+		case x.order != y.order:
+			return x.order < y.order
+		case x.namespace != y.namespace:
+			return x.namespace < y.namespace
+		case x.name != y.name:
+			return x.name < y.name
+		}
+		return x.key < y.key
+	})
+	return keys
+}
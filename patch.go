@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// dataPatch returns the data section of a JSON merge patch that turns from
+// into to. Removed keys are set to null. Values are compared with equal.
+func dataPatch(from, to map[string]string, equal func(a, b string) bool) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k, v := range to {
+		if old, ok := from[k]; !ok || !equal(old, v) {
+			patch[k] = v
+		}
+	}
+	for k := range from {
+		if _, ok := to[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
+
+// jsonPatchOp is an operation of a JSON patch, RFC 6902.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// fieldPatch returns the operations that turn the from map, found at the
+// JSON pointer field, into to. A nil value in to removes the key. Values being replaced or
+// removed are tested first, so the patch fails if another writer changed
+// them since they were read, without conflicting with writes to other keys.
+func fieldPatch(field string, from map[string]string, to map[string]interface{}) []jsonPatchOp {
+	var ops []jsonPatchOp
+	if from == nil {
+		for _, v := range to {
+			if v != nil {
+				ops = append(ops, jsonPatchOp{Op: "add", Path: field, Value: map[string]string{}})
+				break
+			}
+		}
+	}
+	for k, v := range to {
+		p := field + "/" + jsonPointerEscaper.Replace(k)
+		old, ok := from[k]
+		switch {
+		case v == nil && !ok:
+		case v == nil:
+			ops = append(ops,
+				jsonPatchOp{Op: "test", Path: p, Value: old},
+				jsonPatchOp{Op: "remove", Path: p})
+		case !ok:
+			ops = append(ops, jsonPatchOp{Op: "add", Path: p, Value: v})
+		case old != v:
+			ops = append(ops,
+				jsonPatchOp{Op: "test", Path: p, Value: old},
+				jsonPatchOp{Op: "replace", Path: p, Value: v})
+		}
+	}
+	return ops
+}
+
+func (k *k8sClient) patchConfigMap(namespace, name, patchType string, patch interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("error encoding patch for configmap %s: %v", name, err)
+	}
+
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps/%s", k.endpoint, namespace, name)
+	request, err := http.NewRequest(http.MethodPatch, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error patching configmap %s: %v", name, err)
+	}
+	request.Header.Set("Content-Type", patchType)
+
+	resp, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error patching configmap %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return statusError(resp, "error patching configmap "+name)
+	}
+
+	return nil
+}
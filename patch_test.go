@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDataPatch(t *testing.T) {
+	tests := []struct {
+		from, to map[string]string
+		equal    func(a, b string) bool
+		want     map[string]interface{}
+	}{
+		{from: nil, to: nil, want: map[string]interface{}{}},
+		{
+			from: map[string]string{"same": "1", "changed": "1", "removed": "1"},
+			to:   map[string]string{"same": "1", "changed": "2", "added": "1"},
+			want: map[string]interface{}{"changed": "2", "added": "1", "removed": nil},
+		},
+		{
+			// values the compare function considers equal are left alone
+			from:  map[string]string{"a": "x\n"},
+			to:    map[string]string{"a": "x"},
+			equal: func(a, b string) bool { return len(a) > 0 && len(b) > 0 },
+			want:  map[string]interface{}{},
+		},
+	}
+	for _, tt := range tests {
+		equal := tt.equal
+		if equal == nil {
+			equal = func(a, b string) bool { return a == b }
+		}
+		if got := dataPatch(tt.from, tt.to, equal); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("dataPatch(%v, %v) = %v, expected %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestFieldPatch(t *testing.T) {
+	tests := []struct {
+		from map[string]string
+		to   map[string]interface{}
+		want []jsonPatchOp
+	}{
+		{
+			// a missing map is created before keys are added to it
+			from: nil,
+			to:   map[string]interface{}{"a": "1", "b": nil},
+			want: []jsonPatchOp{
+				{Op: "add", Path: "/data", Value: map[string]string{}},
+				{Op: "add", Path: "/data/a", Value: "1"},
+			},
+		},
+		{
+			from: nil,
+			to:   map[string]interface{}{"b": nil},
+			want: nil,
+		},
+		{
+			from: map[string]string{"a": "1", "b": "1", "c": "1"},
+			to:   map[string]interface{}{"a": "2", "b": nil, "c": "1", "d": "1"},
+			want: []jsonPatchOp{
+				{Op: "test", Path: "/data/a", Value: "1"},
+				{Op: "replace", Path: "/data/a", Value: "2"},
+				{Op: "test", Path: "/data/b", Value: "1"},
+				{Op: "remove", Path: "/data/b"},
+				{Op: "add", Path: "/data/d", Value: "1"},
+			},
+		},
+		{
+			// keys are escaped as JSON pointers
+			from: map[string]string{},
+			to:   map[string]interface{}{"conf.d/a~b": "1"},
+			want: []jsonPatchOp{{Op: "add", Path: "/data/conf.d~1a~0b", Value: "1"}},
+		},
+	}
+	for _, tt := range tests {
+		got := fieldPatch("/data", tt.from, tt.to)
+		// keys are patched in no particular order, but the test of a key
+		// comes right before the operation on it
+		sort.SliceStable(got, func(i, j int) bool { return got[i].Path < got[j].Path })
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fieldPatch(%v, %v) = %+v, expected %+v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestPatchConfigMap(t *testing.T) {
+	var method, path, contentType string
+	var body map[string]interface{}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.Path, r.Header.Get("Content-Type")
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &body)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"kind":"Status","reason":"Conflict","message":"conflict"}`))
+	}))
+	defer server.Close()
+
+	k := newk8sClient(server.URL)
+	patch := map[string]interface{}{"data": map[string]interface{}{"a": "1", "b": nil}}
+	if err := k.patchConfigMap("ns", "target", mergePatchType, patch); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPatch || path != "/api/v1/namespaces/ns/configmaps/target" || contentType != mergePatchType {
+		t.Errorf("patch sent as %s %s with %s", method, path, contentType)
+	}
+	if want := map[string]interface{}{"data": map[string]interface{}{"a": "1", "b": nil}}; !reflect.DeepEqual(body, want) {
+		t.Errorf("patch body = %v, expected %v", body, want)
+	}
+
+	status = http.StatusConflict
+	if err := k.patchConfigMap("ns", "target", mergePatchType, patch); err == nil {
+		t.Error("patch rejected by the API server succeeded")
+	}
+}
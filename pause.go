@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pauseRecheckInterval is how often a pause marker is checked while it
+// holds back changes.
+const pauseRecheckInterval = 30 * time.Second
+
+// pauseMarker holds back changes while a resource, such as an Argo CD
+// application or a marker set by a deployment pipeline, shows a sync in
+// progress.
+type pauseMarker struct {
+	spec      string
+	resource  *groupVersionResource
+	namespace string
+	name      string
+	// either an annotation or a field path is checked
+	annotation string
+	field      []string
+	value      string
+	hasValue   bool
+}
+
+// parsePauseMarker parses "<resource> <namespace>/<name> <condition>", where
+// the condition is an annotation, as key or key=value, or a field path and
+// value such as .status.operationState.phase=Running.
+func parsePauseMarker(spec string) (*pauseMarker, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 3 {
+		return nil, errors.Errorf("invalid pause marker %q: expected <resource> <namespace>/<name> <condition>", spec)
+	}
+	gvr, err := parseGroupVersionResource(fields[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pause marker %q", spec)
+	}
+	parts := strings.SplitN(fields[1], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid pause marker %q: expected <namespace>/<name>", spec)
+	}
+	m := &pauseMarker{spec: spec, resource: gvr, namespace: parts[0], name: parts[1]}
+
+	kv := strings.SplitN(fields[2], "=", 2)
+	if len(kv) == 2 {
+		m.value = kv[1]
+		m.hasValue = true
+	}
+	if strings.HasPrefix(kv[0], ".") {
+		if !m.hasValue {
+			return nil, errors.Errorf("invalid pause marker %q: a field needs a value", spec)
+		}
+		if m.field, err = parseFieldPath(kv[0]); err != nil {
+			return nil, errors.Wrapf(err, "invalid pause marker %q", spec)
+		}
+		return m, nil
+	}
+	if err := validateLabelKey(kv[0]); err != nil {
+		return nil, errors.Wrapf(err, "invalid pause marker %q", spec)
+	}
+	m.annotation = kv[0]
+	return m, nil
+}
+
+// active reports whether the marker shows a sync in progress. A marker that
+// does not exist does not pause.
+func (m *pauseMarker) active(client *k8sClient) (bool, error) {
+	obj, err := client.getObject(m.resource, m.namespace, m.name)
+	if err == ErrNotExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get pause marker %s/%s", m.namespace, m.name)
+	}
+
+	path := m.field
+	if m.annotation != "" {
+		path = []string{"metadata", "annotations", m.annotation}
+	}
+	v, ok := getField(obj, path)
+	if !ok {
+		return false, nil
+	}
+	return !m.hasValue || fmt.Sprint(v) == m.value, nil
+}
+
+// paused returns the first marker showing a sync in progress, if any.
+func (c *controller) paused() (*pauseMarker, error) {
+	for _, m := range c.pauseMarkers {
+		active, err := m.active(c.client)
+		if err != nil || active {
+			return m, err
+		}
+	}
+	return nil, nil
+}
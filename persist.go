@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ruleState is what a rule remembers across restarts, so a restarted
+// aggregator does not repeat writes and notifications.
+type ruleState struct {
+	// hash of the aggregate last written to the target
+	Hash string `json:"hash,omitempty"`
+	// resource versions of the sources of that aggregate
+	Sources      string    `json:"sources,omitempty"`
+	StagedHash   string    `json:"stagedHash,omitempty"`
+	StagedAt     time.Time `json:"stagedAt,omitempty"`
+	PromotedHash string    `json:"promotedHash,omitempty"`
+	DriftHash    string    `json:"driftHash,omitempty"`
+	ArchivedHash string    `json:"archivedHash,omitempty"`
+}
+
+type persistedState struct {
+	// state of another shard does not apply
+	Shard string                `json:"shard,omitempty"`
+	Rules map[string]*ruleState `json:"rules"`
+}
+
+// stateStore keeps the state of all rules in a local file, for example on
+// a volume that outlives the container.
+type stateStore struct {
+	path string
+
+	mu    sync.Mutex
+	state persistedState
+}
+
+// loadState reads the state file at path. A missing file, or the file of
+// another shard, starts from an empty state.
+func loadState(path, shard string) (*stateStore, error) {
+	s := &stateStore{path: path, state: persistedState{Shard: shard, Rules: make(map[string]*ruleState)}}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read state file")
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse state file %s", path)
+	}
+	if state.Shard == shard && state.Rules != nil {
+		s.state = state
+	}
+	return s, nil
+}
+
+func (s *stateStore) get(rule string) *ruleState {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.state.Rules[rule]; ok {
+		saved := *r
+		return &saved
+	}
+	return nil
+}
+
+// put records the state of rule, writing the file only if it changed.
+func (s *stateStore) put(rule string, r *ruleState) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.state.Rules[rule]; ok && *old == *r {
+		return nil
+	}
+	saved := *r
+	s.state.Rules[rule] = &saved
+	data, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.path, data); err != nil {
+		return errors.Wrap(err, "failed to write state file")
+	}
+	return nil
+}
+
+// restoreState picks up where the rule left off before a restart.
+func (c *controller) restoreState() {
+	if c.state == nil {
+		return
+	}
+	r := c.state.get(c.name)
+	if r == nil {
+		c.persisted = &ruleState{}
+		return
+	}
+	c.persisted = r
+	c.stagedHash = r.StagedHash
+	c.stagedAt = r.StagedAt
+	c.promotedHash = r.PromotedHash
+	c.driftHash = r.DriftHash
+	if c.staged() && r.StagedHash != r.PromotedHash {
+		if wait := c.promoteAfter - time.Since(c.stagedAt); wait > 0 {
+			time.AfterFunc(wait, c.notify)
+		}
+	}
+}
+
+// saveState records the state of the rule after a sync.
+func (c *controller) saveState() {
+	if c.persisted == nil {
+		return
+	}
+	r := *c.persisted
+	r.StagedHash = c.stagedHash
+	r.StagedAt = c.stagedAt
+	r.PromotedHash = c.promotedHash
+	r.DriftHash = c.driftHash
+	c.persisted = &r
+	if err := c.state.put(c.name, &r); err != nil {
+		c.logf("%v", err)
+	}
+}
+
+// written reports whether the aggregate with hash was written before the
+// aggregator restarted.
+func (r *ruleState) written(hash string) bool {
+	return r != nil && r.Hash == hash
+}
+
+// archived reports whether the archive of the aggregate with hash was
+// published before the aggregator restarted.
+func (r *ruleState) archived(hash string) bool {
+	return r != nil && r.ArchivedHash == hash
+}
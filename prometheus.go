@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// yamlList describes a document whose only top level key is a list, such as
+// a Prometheus rules file. Fragments may be the whole document, just the
+// list, or the JSON equivalent of either.
+type yamlList struct {
+	// top level key of the document
+	key string
+	// key naming each item, which must be unique across fragments
+	nameKey string
+}
+
+var (
+	prometheusRules         = yamlList{key: "groups", nameKey: "name"}
+	prometheusScrapeConfigs = yamlList{key: "scrape_configs", nameKey: "job_name"}
+)
+
+// items returns the list of fragment, dedented so that items start in the
+// first column, and the name of each item.
+func (l yamlList) items(fragment string) ([]string, []string, error) {
+	trimmed := strings.TrimSpace(fragment)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		v, err := parseJSONDocument(trimmed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			v = m[l.key]
+			if len(m) != 1 || v == nil {
+				return nil, nil, errors.Errorf("expected a single %q key", l.key)
+			}
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, nil, errors.Errorf("%q is not a list", l.key)
+		}
+		fragment = toYAML(list)
+	}
+
+	var lines []string
+	inList := true
+	for _, line := range strings.Split(strings.Replace(fragment, "\r\n", "\n", -1), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, " "), "\t") {
+			return nil, nil, errors.New("tabs are not allowed in indentation")
+		}
+		if line == "---" || line == "..." {
+			continue
+		}
+		if line == "" || line[0] == ' ' || line[0] == '#' || line[0] == '-' {
+			if inList {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		switch strings.TrimSpace(line) {
+		case l.key + ":":
+			inList = true
+		case l.key + ": []":
+			inList = false
+		default:
+			return nil, nil, errors.Errorf("unexpected top level key in %q", line)
+		}
+	}
+
+	// dedent, so items start in the first column
+	indent := -1
+	for _, line := range lines {
+		s := strings.TrimLeft(line, " ")
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		if n := len(line) - len(s); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent < 0 {
+		return nil, nil, nil
+	}
+
+	var items, names []string
+	var item []string
+	flush := func() error {
+		if item == nil {
+			return nil
+		}
+		name, ok := l.itemName(item)
+		if !ok {
+			return errors.Errorf("item without %q:\n%s", l.nameKey, strings.Join(item, "\n"))
+		}
+		items = append(items, strings.TrimRight(strings.Join(item, "\n"), "\n"))
+		names = append(names, name)
+		item = nil
+		return nil
+	}
+	for _, line := range lines {
+		if len(line) > indent {
+			line = line[indent:]
+		} else {
+			line = strings.TrimLeft(line, " ")
+		}
+		if line == "-" || strings.HasPrefix(line, "- ") {
+			if err := flush(); err != nil {
+				return nil, nil, err
+			}
+		} else if line != "" && line[0] != ' ' && line[0] != '#' {
+			return nil, nil, errors.Errorf("expected a list item, got %q", line)
+		}
+		if item != nil || (line != "" && line[0] == '-') {
+			item = append(item, line)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, nil, err
+	}
+	return items, names, nil
+}
+
+// itemName returns the value of the name key of a list item.
+func (l yamlList) itemName(item []string) (string, bool) {
+	prefix := l.nameKey + ":"
+	for i, line := range item {
+		if i == 0 {
+			line = " " + strings.TrimPrefix(line, "-")
+		}
+		if !strings.HasPrefix(line, "  "+prefix) {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(line, "  "+prefix))
+		name = strings.Trim(name, `"'`)
+		return name, name != ""
+	}
+	return "", false
+}
+
+// mergeList concatenates the list of each value, in order, into a single
+// document. Fragments that are not valid, or that repeat an item name, are
+// skipped.
+func (c *controller) mergeList(l yamlList, keys []string, data map[string]string) (string, error) {
+	var buf bytes.Buffer
+	seen := make(map[string]string)
+	for _, k := range keys {
+		items, names, err := l.items(data[k])
+		if err == nil {
+			for _, name := range names {
+				if other, ok := seen[name]; ok {
+					err = errors.Errorf("%s %q is already defined by %s", l.nameKey, name, other)
+					break
+				}
+			}
+		}
+		if err != nil {
+			if err := c.warn("skipping %s fragment %s: %v", l.key, k, err); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if len(items) == 0 {
+			continue
+		}
+		for _, name := range names {
+			seen[name] = k
+		}
+		buf.WriteString("  # " + k + "\n")
+		for _, item := range items {
+			for _, line := range strings.Split(item, "\n") {
+				if line != "" {
+					line = "  " + line
+				}
+				buf.WriteString(line + "\n")
+			}
+		}
+	}
+	if buf.Len() == 0 {
+		return l.key + ": []\n", nil
+	}
+	return l.key + ":\n" + buf.String(), nil
+}
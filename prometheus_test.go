@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestYAMLListItems(t *testing.T) {
+	tests := []struct {
+		fragment string
+		items    []string
+		names    []string
+		err      bool
+	}{
+		{
+			fragment: "groups:\n- name: a\n  rules:\n  - alert: X\n- name: b\n",
+			items:    []string{"- name: a\n  rules:\n  - alert: X", "- name: b"},
+			names:    []string{"a", "b"},
+		},
+		{
+			// just the list, indented, with comments and quoted names
+			fragment: "    # team a\n    - name: \"a\"\n      rules: []\n",
+			items:    []string{"- name: \"a\"\n  rules: []"},
+			names:    []string{"a"},
+		},
+		{
+			// the name need not be the first key
+			fragment: "---\ngroups:\n-\n  interval: 1m\n  name: a\n",
+			items:    []string{"-\n  interval: 1m\n  name: a"},
+			names:    []string{"a"},
+		},
+		{
+			fragment: `{"groups": [{"name": "a", "rules": []}]}`,
+			items:    []string{"- name: \"a\"\n  rules: []"},
+			names:    []string{"a"},
+		},
+		{
+			fragment: `[{"name": "a"}]`,
+			items:    []string{"- name: \"a\""},
+			names:    []string{"a"},
+		},
+		{fragment: "groups: []\n"},
+		{fragment: ""},
+		{fragment: "groups:\n- rules: []\n", err: true},
+		{fragment: "other:\n- name: a\n", err: true},
+		{fragment: "groups:\n\t- name: a\n", err: true},
+		{fragment: `{"groups": [], "other": 1}`, err: true},
+		{fragment: `{"groups": {}}`, err: true},
+		{fragment: "- name: a\nrules: []\n", err: true},
+	}
+	for _, tt := range tests {
+		items, names, err := prometheusRules.items(tt.fragment)
+		if tt.err {
+			if err == nil {
+				t.Errorf("items(%q) succeeded, expected an error", tt.fragment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("items(%q): %v", tt.fragment, err)
+			continue
+		}
+		if !reflect.DeepEqual(items, tt.items) || !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("items(%q) = %q, %q, expected %q, %q", tt.fragment, items, names, tt.items, tt.names)
+		}
+	}
+}
+
+func TestMergeList(t *testing.T) {
+	tests := []struct {
+		data map[string]string
+		want string
+	}{
+		{data: map[string]string{}, want: "scrape_configs: []\n"},
+		{
+			data: map[string]string{
+				"a": "scrape_configs:\n- job_name: a\n  static_configs:\n  - targets: [x]\n",
+				"b": "- job_name: b\n",
+			},
+			want: "scrape_configs:\n  # a\n  - job_name: a\n    static_configs:\n    - targets: [x]\n  # b\n  - job_name: b\n",
+		},
+		{
+			// fragments repeating a job name or not parsing are skipped
+			data: map[string]string{
+				"a": "- job_name: a\n",
+				"b": "- job_name: a\n",
+				"c": "- targets: []\n",
+				"d": "scrape_configs: []\n",
+			},
+			want: "scrape_configs:\n  # a\n  - job_name: a\n",
+		},
+	}
+	for _, tt := range tests {
+		c := &controller{}
+		got, err := c.mergeList(prometheusScrapeConfigs, sortedKeys(tt.data), tt.data)
+		if err != nil {
+			t.Errorf("mergeList(%v): %v", tt.data, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("mergeList(%v) = %q, expected %q", tt.data, got, tt.want)
+		}
+		if _, err := parseYAMLDocument(got); err != nil {
+			t.Errorf("mergeList(%v) is not valid YAML: %v", tt.data, err)
+		}
+	}
+}
+
+func TestMergeListStrict(t *testing.T) {
+	c := &controller{strict: true}
+	data := map[string]string{"a": "- job_name: a\n", "b": "- job_name: a\n"}
+	if _, err := c.mergeList(prometheusScrapeConfigs, sortedKeys(data), data); err == nil {
+		t.Error("mergeList of a repeated job name succeeded in strict mode")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// observedChange is a change to a source seen by a watch.
+type observedChange struct {
+	source string
+	at     time.Time
+}
+
+// observedChanges records when a watch observed changes to sources, until
+// a sync propagates them to the target.
+type observedChanges struct {
+	mu      sync.Mutex
+	changes map[string]observedChange
+}
+
+func newObservedChanges() *observedChanges {
+	return &observedChanges{changes: make(map[string]observedChange)}
+}
+
+func (o *observedChanges) add(cm *ConfigMap, t time.Time) {
+	source := contributionKey(cm)
+	key := source + "@" + cm.Metadata.ResourceVersion
+	o.mu.Lock()
+	if _, ok := o.changes[key]; !ok {
+		o.changes[key] = observedChange{source: source, at: t}
+	}
+	o.mu.Unlock()
+}
+
+// take returns the observed changes and forgets them.
+func (o *observedChanges) take() map[string]observedChange {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changes := o.changes
+	o.changes = make(map[string]observedChange)
+	return changes
+}
+
+// restore puts back changes that were not propagated.
+func (o *observedChanges) restore(changes map[string]observedChange) {
+	o.mu.Lock()
+	for k, ch := range changes {
+		if old, ok := o.changes[k]; !ok || ch.at.Before(old.at) {
+			o.changes[k] = ch
+		}
+	}
+	o.mu.Unlock()
+}
+
+// sourceKeys maps each source to the keys of the aggregate its entries went
+// into. Entries merged into a document or a single value, or rewritten by a
+// transform, are no longer keys of data, so such sources are mapped to every
+// key.
+func sourceKeys(entries map[string][]string, data map[string]string) map[string][]string {
+	all := make([]string, 0, len(data))
+	for k := range data {
+		all = append(all, k)
+	}
+	keys := make(map[string][]string, len(entries))
+	for source, names := range entries {
+		for _, n := range names {
+			if _, ok := data[n]; ok {
+				keys[source] = append(keys[source], n)
+			}
+		}
+		if len(keys[source]) == 0 {
+			keys[source] = all
+		}
+	}
+	return keys
+}
+
+// propagated records the delay until observed changes reached the target,
+// for the sources whose keys changed in it. Sources that are no longer part
+// of the aggregate count if keys were removed.
+func (c *controller) propagated(observed map[string]observedChange, changes *changeSet) {
+	if changes.empty() {
+		return
+	}
+	changed := make(map[string]bool)
+	for _, k := range changes.keys() {
+		changed[k] = true
+	}
+	now := time.Now()
+	for _, o := range observed {
+		keys, ok := c.sourceKeys[o.source]
+		hit := !ok && len(changes.Removed) > 0
+		for _, k := range keys {
+			if changed[k] {
+				hit = true
+				break
+			}
+		}
+		if hit {
+			propagationDelay.observe(now.Sub(o.at).Seconds(), "rule", c.name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxNamespaceBackoff caps the delay before a namespace that failed to list
+// is retried.
+const maxNamespaceBackoff = 5 * time.Minute
+
+// namespaceQueue tracks, in watch mode, which namespaces changed since they
+// were last listed, so a sync only lists those. A namespace that fails to
+// list keeps its last list and is retried on its own with backoff, rather
+// than failing the sync of every namespace.
+type namespaceQueue struct {
+	mu       sync.Mutex
+	lists    map[string]*ConfigMapList
+	dirty    map[string]bool
+	failures map[string]int
+}
+
+func newNamespaceQueue() *namespaceQueue {
+	return &namespaceQueue{
+		lists:    make(map[string]*ConfigMapList),
+		dirty:    make(map[string]bool),
+		failures: make(map[string]int),
+	}
+}
+
+// add marks namespace as changed. Without a queue, every sync lists all
+// namespaces anyway.
+func (q *namespaceQueue) add(namespace string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dirty[namespace] = true
+}
+
+// addAll marks every namespace as changed, for a full resync.
+func (q *namespaceQueue) addAll() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for n := range q.lists {
+		q.dirty[n] = true
+	}
+}
+
+// next returns the last list of namespace if it did not change since.
+// Otherwise the namespace is taken off the queue to be listed again, and
+// events that arrive while it is listed put it back.
+func (q *namespaceQueue) next(namespace string) (*ConfigMapList, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list, ok := q.lists[namespace]
+	if ok && !q.dirty[namespace] {
+		return list, true
+	}
+	delete(q.dirty, namespace)
+	return nil, false
+}
+
+// done records a successful list of namespace.
+func (q *namespaceQueue) done(namespace string, list *ConfigMapList) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lists[namespace] = list
+	delete(q.failures, namespace)
+}
+
+// failed records a failed list of namespace and returns its last list, if
+// any, along with how long to wait before retrying.
+func (q *namespaceQueue) failed(namespace string) (*ConfigMapList, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dirty[namespace] = true
+	n := q.failures[namespace]
+	q.failures[namespace] = n + 1
+	backoff := time.Second
+	for i := 0; i < n && backoff < maxNamespaceBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxNamespaceBackoff {
+		backoff = maxNamespaceBackoff
+	}
+	list, ok := q.lists[namespace]
+	return list, backoff, ok
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+)
+
+var rbacCmd = &cobra.Command{
+	Use:   "rbac [target-namespace] [target-name] | rbac [namespace] --rules-file=...",
+	Short: "print the RBAC manifests needed to aggregate into the target",
+	Run:   runRBAC,
+}
+
+var serviceAccount string
+
+type rbacRole struct {
+	Namespace string
+	Name      string
+	Verbs     []string
+}
+
+// rbacReadRole grants get on single objects of a namespace.
+type rbacReadRole struct {
+	Namespace string
+	Name      string
+	Rules     []rbacReadRule
+}
+
+type rbacReadRule struct {
+	Group        string
+	Resource     string
+	ResourceName string
+}
+
+type rbacConfig struct {
+	Name                    string
+	ServiceAccount          string
+	ServiceAccountNamespace string
+	TargetNamespace         string
+	TargetName              string
+	// written before the target when changes are staged
+	StagingName string
+	// cluster wide access is needed when all namespaces are searched
+	Cluster     bool
+	SourceVerbs []string
+	SourceGroup string
+	// plural resource name of the sources
+	SourceResource string
+	SourceRoles    []rbacRole
+	TargetVerbs    []string
+	TargetGroup    string
+	// plural resource name of the target
+	TargetResource string
+	RecordEvents   bool
+	// namespaces are watched, and listed when discovered by label
+	WatchNamespaces bool
+	// stale targets are found and deleted across the cluster
+	GarbageCollect bool
+	// objects read to decide whether changes are frozen
+	ReadRoles []rbacReadRole
+}
+
+// addRead grants get on one object, in a role per namespace.
+func (r *rbacConfig) addRead(namespace, group, resource, name string) {
+	rule := rbacReadRule{Group: group, Resource: resource, ResourceName: name}
+	for i := range r.ReadRoles {
+		if r.ReadRoles[i].Namespace == namespace {
+			r.ReadRoles[i].Rules = append(r.ReadRoles[i].Rules, rule)
+			return
+		}
+	}
+	r.ReadRoles = append(r.ReadRoles, rbacReadRole{
+		Namespace: namespace,
+		Name:      r.Name + "-freeze",
+		Rules:     []rbacReadRule{rule},
+	})
+}
+
+var serviceAccountTemplate = template.Must(template.New("serviceaccount").Parse(`---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{.ServiceAccount}}
+  namespace: {{.ServiceAccountNamespace}}`))
+
+var rbacTemplate = template.Must(template.New("rbac").Parse(`
+{{- if .Cluster}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{.Name}}-sources
+rules:
+- apiGroups: ["{{.SourceGroup}}"]
+  resources: ["{{.SourceResource}}"]
+  verbs: [{{range $i, $v := .SourceVerbs}}{{if $i}}, {{end}}"{{$v}}"{{end}}]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{.Name}}-sources
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{.Name}}-sources
+subjects:
+- kind: ServiceAccount
+  name: {{.ServiceAccount}}
+  namespace: {{.ServiceAccountNamespace}}
+{{- end}}
+{{- if .WatchNamespaces}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{.Name}}-namespaces
+rules:
+- apiGroups: [""]
+  resources: ["namespaces"]
+  verbs: ["list", "watch"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{.Name}}-namespaces
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{.Name}}-namespaces
+subjects:
+- kind: ServiceAccount
+  name: {{.ServiceAccount}}
+  namespace: {{.ServiceAccountNamespace}}
+{{- end}}
+{{- if .GarbageCollect}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{.Name}}-gc
+rules:
+- apiGroups: [""]
+  resources: ["configmaps"]
+  verbs: ["list", "delete"]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{.Name}}-gc
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{.Name}}-gc
+subjects:
+- kind: ServiceAccount
+  name: {{.ServiceAccount}}
+  namespace: {{.ServiceAccountNamespace}}
+{{- end}}
+{{- range .SourceRoles}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+rules:
+- apiGroups: ["{{$.SourceGroup}}"]
+  resources: ["{{$.SourceResource}}"]
+  verbs: [{{range $i, $v := .Verbs}}{{if $i}}, {{end}}"{{$v}}"{{end}}]
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.Name}}
+subjects:
+- kind: ServiceAccount
+  name: {{$.ServiceAccount}}
+  namespace: {{$.ServiceAccountNamespace}}
+{{- end}}
+{{- range .ReadRoles}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+rules:
+{{- range .Rules}}
+- apiGroups: ["{{.Group}}"]
+  resources: ["{{.Resource}}"]
+  resourceNames: ["{{.ResourceName}}"]
+  verbs: ["get"]
+{{- end}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.Name}}
+subjects:
+- kind: ServiceAccount
+  name: {{$.ServiceAccount}}
+  namespace: {{$.ServiceAccountNamespace}}
+{{- end}}
+{{- if .TargetName}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{.Name}}-target
+  namespace: {{.TargetNamespace}}
+rules:
+- apiGroups: ["{{.TargetGroup}}"]
+  resources: ["{{.TargetResource}}"]
+  verbs: ["create"]
+- apiGroups: ["{{.TargetGroup}}"]
+  resources: ["{{.TargetResource}}"]
+  resourceNames: ["{{.TargetName}}"{{if .StagingName}}, "{{.StagingName}}"{{end}}]
+  verbs: [{{range $i, $v := .TargetVerbs}}{{if $i}}, {{end}}"{{$v}}"{{end}}]
+{{- if .RecordEvents}}
+- apiGroups: [""]
+  resources: ["events"]
+  verbs: ["create"]
+{{- end}}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{.Name}}-target
+  namespace: {{.TargetNamespace}}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{.Name}}-target
+subjects:
+- kind: ServiceAccount
+  name: {{.ServiceAccount}}
+  namespace: {{.ServiceAccountNamespace}}
+{{- end}}
+`))
+
+// newRBACConfig computes the permissions needed for a rule and the current flags.
+func newRBACConfig(rl *rule, serviceAccountNamespace string) *rbacConfig {
+	name := rl.TargetName
+	if rl.OutputDir != "" {
+		name = "files"
+	}
+	r := &rbacConfig{
+		Name:                    "configmap-aggregator-" + name,
+		ServiceAccount:          serviceAccount,
+		ServiceAccountNamespace: serviceAccountNamespace,
+		TargetNamespace:         rl.TargetNamespace,
+		TargetName:              rl.TargetName,
+		StagingName:             stagingName,
+		SourceVerbs:             []string{"list"},
+		TargetVerbs:             []string{"get", "update", "patch"},
+		TargetResource:          "configmaps",
+		SourceResource:          "configmaps",
+		// limit and validation failures are recorded as events
+		RecordEvents: true,
+	}
+	if targetResource != "" {
+		if gvr, err := parseGroupVersionResource(targetResource); err == nil {
+			r.TargetGroup = gvr.Group
+			r.TargetResource = gvr.Resource
+		}
+	}
+	if sourceResource != "" {
+		if gvr, err := parseGroupVersionResource(sourceResource); err == nil {
+			r.SourceGroup = gvr.Group
+			r.SourceResource = gvr.Resource
+		}
+	}
+	if watch {
+		r.SourceVerbs = append(r.SourceVerbs, "watch")
+	}
+
+	r.GarbageCollect = instance != ""
+	if parts := strings.SplitN(freezeConfigMap, "/", 2); len(parts) == 2 {
+		r.addRead(parts[0], "", "configmaps", parts[1])
+	}
+	for _, spec := range pauseSpecs {
+		if m, err := parsePauseMarker(spec); err == nil {
+			r.addRead(m.namespace, m.resource.Group, m.resource.Resource, m.name)
+		}
+	}
+	r.WatchNamespaces = rl.NamespaceSelector != "" || (len(rl.Namespaces) > 0 && !onetime)
+
+	if len(rl.Namespaces) == 0 {
+		r.Cluster = true
+		return r
+	}
+	for _, n := range rl.Namespaces {
+		r.SourceRoles = append(r.SourceRoles, rbacRole{
+			Namespace: n,
+			Name:      r.Name + "-sources",
+			Verbs:     r.SourceVerbs,
+		})
+	}
+	return r
+}
+
+func runRBAC(cmd *cobra.Command, args []string) {
+	rules, namespace, err := rulesFromArgs(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if namespace == "" {
+		log.Fatal("namespace of the service account is required")
+	}
+
+	if err := serviceAccountTemplate.Execute(os.Stdout, newRBACConfig(rules[0], namespace)); err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range rules {
+		if err := rbacTemplate.Execute(os.Stdout, newRBACConfig(r, namespace)); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// groupVersionResource identifies an arbitrary API resource, such as a
+// custom resource, for use with the untyped object functions below.
+type groupVersionResource struct {
+	Group    string
+	Version  string
+	Resource string
+}
+
+// parseGroupVersionResource parses group/version/resource, or version/resource
+// for the core group.
+func parseGroupVersionResource(s string) (*groupVersionResource, error) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 2:
+		return &groupVersionResource{Version: parts[0], Resource: parts[1]}, nil
+	case 3:
+		return &groupVersionResource{Group: parts[0], Version: parts[1], Resource: parts[2]}, nil
+	}
+	return nil, errors.Errorf("invalid resource %q: expected group/version/resource", s)
+}
+
+func (g *groupVersionResource) apiVersion() string {
+	if g.Group == "" {
+		return g.Version
+	}
+	return g.Group + "/" + g.Version
+}
+
+func (g *groupVersionResource) path(namespace, name string) string {
+	path := "/apis/" + g.Group + "/" + g.Version
+	if g.Group == "" {
+		path = "/api/" + g.Version
+	}
+	if namespace != "" {
+		path = path + "/namespaces/" + namespace
+	}
+	path = path + "/" + g.Resource
+	if name != "" {
+		path = path + "/" + name
+	}
+	return path
+}
+
+// parseFieldPath parses a simple JSONPath such as .spec.data or {.spec.data}.
+func parseFieldPath(s string) ([]string, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "$"), ".")
+	if s == "" {
+		return nil, errors.New("empty field path")
+	}
+	fields := strings.Split(s, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil, errors.Errorf("invalid field path %q", s)
+		}
+	}
+	return fields, nil
+}
+
+func getField(obj map[string]interface{}, fields []string) (interface{}, bool) {
+	var v interface{} = obj
+	for _, f := range fields {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[f]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func setField(obj map[string]interface{}, fields []string, value interface{}) {
+	m := obj
+	for _, f := range fields[:len(fields)-1] {
+		next, ok := m[f].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[f] = next
+		}
+		m = next
+	}
+	m[fields[len(fields)-1]] = value
+}
+
+func (k *k8sClient) getObject(gvr *groupVersionResource, namespace, name string) (map[string]interface{}, error) {
+	resp, err := k.client.Get(k.endpoint + gvr.path(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, ErrNotExist
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("error getting %s %s; got HTTP %v status code", gvr.Resource, name, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (k *k8sClient) createObject(gvr *groupVersionResource, namespace string, obj map[string]interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", gvr.Resource, err)
+	}
+	resp, err := k.client.Post(k.endpoint+gvr.path(namespace, ""), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", gvr.Resource, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return statusError(resp, "error creating "+gvr.Resource)
+	}
+	return nil
+}
+
+func (k *k8sClient) updateObject(gvr *groupVersionResource, namespace, name string, obj map[string]interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("error encoding %s %s: %v", gvr.Resource, name, err)
+	}
+	request, err := http.NewRequest(http.MethodPut, k.endpoint+gvr.path(namespace, name), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error updating %s %s: %v", gvr.Resource, name, err)
+	}
+	resp, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error updating %s %s: %v", gvr.Resource, name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return statusError(resp, "error updating "+gvr.Resource+" "+name)
+	}
+	return nil
+}
+
+// upsertResource writes the aggregated data into a field of an arbitrary
+// resource rather than a config map.
+func (c *controller) upsertResource(cm *ConfigMap) (*changeSet, error) {
+	data := make(map[string]interface{}, len(cm.Data))
+	for k, v := range cm.Data {
+		data[k] = v
+	}
+
+	obj, err := c.client.getObject(c.targetResource, c.targetNamespace, c.targetName)
+	if err == ErrNotExist {
+		obj = map[string]interface{}{
+			"apiVersion": c.targetResource.apiVersion(),
+			"kind":       c.targetKind,
+			"metadata": map[string]interface{}{
+				"name":        c.targetName,
+				"namespace":   c.targetNamespace,
+				"labels":      cm.Metadata.Labels,
+				"annotations": cm.Metadata.Annotations,
+			},
+		}
+		setField(obj, c.targetField, data)
+		if err := c.client.createObject(c.targetResource, c.targetNamespace, obj); err != nil {
+			return nil, err
+		}
+		c.lastWrite = time.Now()
+		return c.diff(newConfigMap(c.targetNamespace, c.targetName), cm), nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s %s/%s", c.targetResource.Resource, c.targetNamespace, c.targetName)
+	}
+
+	labels := make(map[string]string)
+	if v, ok := getField(obj, []string{"metadata", "labels"}); ok {
+		m, _ := v.(map[string]interface{})
+		for k, v := range m {
+			labels[k] = fmt.Sprint(v)
+		}
+	}
+	if err := c.checkOwner(labels); err != nil {
+		return nil, err
+	}
+
+	existing := newConfigMap(c.targetNamespace, c.targetName)
+	if v, ok := getField(obj, c.targetField); ok {
+		m, _ := v.(map[string]interface{})
+		for k, v := range m {
+			existing.Data[k] = fmt.Sprint(v)
+		}
+	}
+	changes := c.diff(existing, cm)
+	if changes.empty() {
+		return changes, nil
+	}
+	if err := c.checkRemoved(existing, cm); err != nil {
+		return nil, err
+	}
+
+	setField(obj, c.targetField, data)
+	setField(obj, []string{"metadata", "annotations", "configmap-aggregator/version"}, version)
+	if v, ok := cm.Metadata.Annotations[sourcesAnnotation]; ok {
+		setField(obj, []string{"metadata", "annotations", sourcesAnnotation}, v)
+	}
+	for k, v := range c.targetLabels {
+		setField(obj, []string{"metadata", "labels", k}, v)
+	}
+	for k, v := range c.targetAnnotations {
+		setField(obj, []string{"metadata", "annotations", k}, v)
+	}
+	if err := c.client.updateObject(c.targetResource, c.targetNamespace, c.targetName, obj); err != nil {
+		return nil, err
+	}
+	c.lastWrite = time.Now()
+	return changes, nil
+}
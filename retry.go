@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxListBackoff caps the delay between list retries.
+const maxListBackoff = 30 * time.Second
+
+// retryingLister retries failed lists of another lister with exponential
+// backoff and jitter, so transient API errors do not fail a sync.
+type retryingLister struct {
+	ConfigMapLister
+	retries int
+	backoff time.Duration
+}
+
+func (l *retryingLister) List(namespace, selector string) (*ConfigMapList, error) {
+	delay := l.backoff
+	for attempt := 0; ; attempt++ {
+		list, err := l.ConfigMapLister.List(namespace, selector)
+		// a forbidden namespace will not become readable by retrying
+		if err == nil || err == ErrForbidden || attempt >= l.retries {
+			return list, err
+		}
+		// full jitter spreads out retries of rules listing at the same time
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		log.Printf("failed to list config maps in %q, retrying in %v: %v", namespace, wait, err)
+		time.Sleep(wait)
+		if delay *= 2; delay > maxListBackoff {
+			delay = maxListBackoff
+		}
+	}
+}
+
+func (l *retryingLister) watch(namespace, selector string, done <-chan struct{}, fn func(WatchEvent)) error {
+	w, ok := l.ConfigMapLister.(watcher)
+	if !ok {
+		return errors.New("source does not support watching")
+	}
+	return w.watch(namespace, selector, done, fn)
+}
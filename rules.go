@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rule describes one target to aggregate into. A rules file holds a JSON
+// list of rules so a single process can maintain several targets.
+type rule struct {
+	Name            string `json:"name"`
+	TargetNamespace string `json:"targetNamespace"`
+	TargetName      string `json:"targetName"`
+	Selector        string `json:"selector"`
+	// sources matching any of these, or selector, are aggregated
+	Selectors         []string `json:"selectors"`
+	Namespaces        []string `json:"namespaces"`
+	NamespaceSelector string   `json:"namespaceSelector"`
+	// a duration such as 30s or 1h. defaults to --sync-interval
+	SyncInterval string `json:"syncInterval"`
+	// a cron expression used instead of the sync interval
+	Schedule string `json:"schedule"`
+	// a directory to write files to instead of a target config map
+	OutputDir string `json:"outputDir"`
+	// names keys and files. defaults to --key-template
+	KeyTemplate string `json:"keyTemplate"`
+
+	syncInterval time.Duration
+	schedule     *cronSchedule
+	keyTemplate  *template.Template
+	selectors    []string
+}
+
+func (r *rule) validate() error {
+	if r.OutputDir != "" {
+		if r.TargetNamespace != "" || r.TargetName != "" {
+			return errors.New("targetNamespace and targetName can not be used with outputDir")
+		}
+		if r.Name == "" {
+			r.Name = r.OutputDir
+		}
+	} else if r.TargetNamespace == "" || r.TargetName == "" {
+		return errors.New("targetNamespace and targetName are required")
+	}
+	if r.Name == "" {
+		r.Name = r.TargetNamespace + "/" + r.TargetName
+	}
+	r.selectors = nil
+	for _, s := range append([]string{r.Selector}, r.Selectors...) {
+		if s == "" {
+			continue
+		}
+		if _, err := parseSelector(s); err != nil {
+			return errors.Wrapf(err, "rule %s", r.Name)
+		}
+		r.selectors = append(r.selectors, s)
+	}
+	if _, err := parseSelector(r.NamespaceSelector); err != nil {
+		return errors.Wrapf(err, "rule %s: namespace selector", r.Name)
+	}
+	if r.NamespaceSelector != "" && len(r.Namespaces) > 0 {
+		return errors.Errorf("rule %s: namespaces and namespaceSelector can not be used together", r.Name)
+	}
+
+	if r.SyncInterval != "" && r.Schedule != "" {
+		return errors.Errorf("rule %s: syncInterval and schedule can not be used together", r.Name)
+	}
+
+	r.syncInterval = syncInterval
+	if r.SyncInterval != "" {
+		d, err := time.ParseDuration(r.SyncInterval)
+		if err != nil {
+			return errors.Wrapf(err, "rule %s: invalid syncInterval", r.Name)
+		}
+		r.syncInterval = d
+	}
+	if r.KeyTemplate == "" {
+		r.KeyTemplate = keyTemplate
+	}
+	t, err := parseKeyTemplate(r.KeyTemplate)
+	if err != nil {
+		return errors.Wrapf(err, "rule %s", r.Name)
+	}
+	r.keyTemplate = t
+
+	if r.Schedule != "" {
+		s, err := parseCronSchedule(r.Schedule)
+		if err != nil {
+			return errors.Wrapf(err, "rule %s", r.Name)
+		}
+		r.schedule = s
+	}
+	return nil
+}
+
+// id identifies the rule by what it aggregates and where to, so aggregator
+// instances can tell their targets apart.
+func (r *rule) id() string {
+	h := fnv.New64()
+	fmt.Fprintf(h, "%q %q %q %q %q %q", r.selectors, r.Namespaces, r.NamespaceSelector, r.TargetNamespace, r.TargetName, r.OutputDir)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadRules reads a rules file. Rules without namespaces default to
+// namespace, if it is set.
+func loadRules(path, namespace string) ([]*rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read rules file %s", path)
+	}
+	var rules []*rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse rules file %s", path)
+	}
+	if len(rules) == 0 {
+		return nil, errors.Errorf("no rules in %s", path)
+	}
+	for _, r := range rules {
+		if namespace != "" {
+			r.defaultNamespace(namespace)
+		}
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// rulesFromArgs returns the rules in --rules-file, or the single rule given
+// by the target arguments and flags. The namespace the aggregator runs in is
+// the first argument, if any.
+func rulesFromArgs(args []string) ([]*rule, string, error) {
+	// in local mode the pod namespace is the default for everything, so
+	// only the target name is given
+	var localNamespace string
+	if local {
+		ns, err := podNamespace()
+		if err != nil {
+			return nil, "", err
+		}
+		localNamespace = ns
+		if len(args) == 1 && rulesFile == "" && outputDir == "" {
+			args = []string{ns, args[0]}
+		}
+		if len(args) == 0 {
+			args = []string{ns}
+		}
+	}
+
+	var namespace string
+	if len(args) > 0 {
+		namespace = args[0]
+	}
+
+	if rulesFile != "" {
+		if len(args) > 1 {
+			return nil, "", errors.New("target configmap can not be given with rules-file")
+		}
+		rules, err := loadRules(rulesFile, localNamespace)
+		if err != nil {
+			return nil, "", err
+		}
+		return rules, namespace, suffixShard(rules)
+	}
+
+	for _, l := range matchLabels {
+		if !strings.Contains(l, "=") {
+			return nil, "", errors.Errorf("invalid match-label %q: expected <key>=<value>", l)
+		}
+	}
+	r := &rule{
+		Selectors:         combineSelectors(selectors, append(matchLabels, matchExpressions...)),
+		Namespaces:        namespaces,
+		NamespaceSelector: namespaceSelector,
+		Schedule:          schedule,
+	}
+	switch {
+	case outputDir != "":
+		// the only argument, if any, is the namespace the aggregator runs in
+		if len(args) > 1 {
+			return nil, "", errors.New("target configmap can not be given with output-dir")
+		}
+		r.OutputDir = outputDir
+	case len(args) == 2:
+		r.TargetNamespace = args[0]
+		r.TargetName = args[1]
+	default:
+		return nil, "", errors.New("namespace and name of target configmap is required")
+	}
+	if localNamespace != "" {
+		r.defaultNamespace(localNamespace)
+	}
+	if err := r.validate(); err != nil {
+		return nil, "", err
+	}
+	return []*rule{r}, namespace, suffixShard([]*rule{r})
+}
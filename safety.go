@@ -0,0 +1,61 @@
+package main
+
+import "github.com/pkg/errors"
+
+// checkMinSources refuses to update the target when fewer sources than
+// expected were found, which usually means listing went wrong rather than
+// that teams removed their config maps.
+func (c *controller) checkMinSources(sources int) error {
+	if c.minSources > 0 && sources < c.minSources {
+		return c.safetyBreach("min-sources", errors.Errorf("found %d source config maps, expected at least %d", sources, c.minSources))
+	}
+	return nil
+}
+
+// checkRemoved refuses to replace existing with cm when that would remove
+// too large a fraction of the keys at once.
+func (c *controller) checkRemoved(existing, cm *ConfigMap) error {
+	total := len(existing.Data) + len(existing.BinaryData)
+	if c.maxRemovedFraction <= 0 || total == 0 {
+		return nil
+	}
+
+	removed := 0
+	for _, keys := range []map[string]bool{stringKeys(existing.Data), bytesKeys(existing.BinaryData)} {
+		for k := range keys {
+			_, inData := cm.Data[k]
+			_, inBinaryData := cm.BinaryData[k]
+			if !inData && !inBinaryData {
+				removed++
+			}
+		}
+	}
+	if fraction := float64(removed) / float64(total); fraction > c.maxRemovedFraction {
+		return c.safetyBreach("max-removed-fraction", errors.Errorf("update would remove %d of %d keys", removed, total))
+	}
+	return nil
+}
+
+// safetyBreach counts and records a breached safety threshold and returns
+// the error that fails the sync.
+func (c *controller) safetyBreach(reason string, err error) error {
+	safetyBreachesTotal.add(1, "rule", c.name, "reason", reason)
+	c.recordEvent("Warning", "SafetyThresholdBreached", "refusing to update target: %v", err)
+	return errors.Wrap(err, "refusing to update target")
+}
+
+func stringKeys(m map[string]string) map[string]bool {
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys
+}
+
+func bytesKeys(m map[string][]byte) map[string]bool {
+	keys := make(map[string]bool, len(m))
+	for k := range m {
+		keys[k] = true
+	}
+	return keys
+}
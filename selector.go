@@ -0,0 +1,175 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The API server rejects invalid label selectors, so they are checked at
+// startup rather than failing every sync. This follows the selector syntax
+// of k8s.io/apimachinery/pkg/labels.
+
+var (
+	labelName      = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+	labelPrefix    = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	selectorSetOps = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// labelRequirement is a single requirement of a selector.
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+func validateLabelKey(key string) error {
+	name := key
+	if i := strings.Index(key, "/"); i >= 0 {
+		prefix := key[:i]
+		name = key[i+1:]
+		if prefix == "" || len(prefix) > 253 || !labelPrefix.MatchString(prefix) {
+			return errors.Errorf("invalid label key %q: prefix must be a DNS subdomain", key)
+		}
+	}
+	if name == "" || len(name) > 63 || !labelName.MatchString(name) {
+		return errors.Errorf("invalid label key %q: name must be 63 characters or less, beginning and ending with an alphanumeric character, with '-', '_', '.', or alphanumerics between", key)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if len(value) > 63 || !labelName.MatchString(value) {
+		return errors.Errorf("invalid label value %q: must be 63 characters or less, beginning and ending with an alphanumeric character, with '-', '_', '.', or alphanumerics between", value)
+	}
+	return nil
+}
+
+// splitSelector splits a selector on the commas that separate requirements,
+// leaving those within a set of values.
+func splitSelector(s string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("unbalanced parentheses")
+			}
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses")
+	}
+	return append(parts, s[start:]), nil
+}
+
+func parseRequirement(s string) (*labelRequirement, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty requirement")
+	}
+
+	var r *labelRequirement
+	if m := selectorSetOps.FindStringSubmatch(s); m != nil {
+		r = &labelRequirement{key: m[1], operator: m[2]}
+		for _, v := range strings.Split(m[3], ",") {
+			r.values = append(r.values, strings.TrimSpace(v))
+		}
+	} else {
+		for _, op := range []string{"!=", "==", "="} {
+			if i := strings.Index(s, op); i >= 0 {
+				r = &labelRequirement{
+					key:      strings.TrimSpace(s[:i]),
+					operator: op,
+					values:   []string{strings.TrimSpace(s[i+len(op):])},
+				}
+				break
+			}
+		}
+	}
+	if r == nil {
+		r = &labelRequirement{key: s, operator: "exists"}
+		if strings.HasPrefix(s, "!") {
+			r = &labelRequirement{key: strings.TrimSpace(s[1:]), operator: "!"}
+		}
+	}
+
+	if err := validateLabelKey(r.key); err != nil {
+		return nil, err
+	}
+	for _, v := range r.values {
+		if err := validateLabelValue(v); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// parseSelector parses a label selector such as "app=web,tier in (a,b),!canary".
+func parseSelector(s string) ([]*labelRequirement, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	parts, err := splitSelector(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid selector %q", s)
+	}
+	var reqs []*labelRequirement
+	for _, p := range parts {
+		r, err := parseRequirement(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid selector %q", s)
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// combineSelectors adds the requirements to each selector, or returns them as
+// the only selector if there are none.
+func combineSelectors(selectors, requirements []string) []string {
+	if len(requirements) == 0 {
+		return selectors
+	}
+	extra := strings.Join(requirements, ",")
+	if len(selectors) == 0 {
+		return []string{extra}
+	}
+	combined := make([]string, len(selectors))
+	for i, s := range selectors {
+		combined[i] = s + "," + extra
+	}
+	return combined
+}
+
+// parseLabels parses key=value pairs given to flag. Values are validated as
+// label values when labels is set, as annotation values can be anything.
+func parseLabels(flag string, specs []string, labels bool) (map[string]string, error) {
+	m := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid %s %q: expected <key>=<value>", flag, spec)
+		}
+		if err := validateLabelKey(parts[0]); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", flag)
+		}
+		if labels {
+			if err := validateLabelValue(parts[1]); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", flag)
+			}
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
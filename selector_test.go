@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     []*labelRequirement
+		err      bool
+	}{
+		{selector: "", want: nil},
+		{selector: "  ", want: nil},
+		{
+			selector: "app=web",
+			want:     []*labelRequirement{{key: "app", operator: "=", values: []string{"web"}}},
+		},
+		{
+			selector: "app == web, tier!=db",
+			want: []*labelRequirement{
+				{key: "app", operator: "==", values: []string{"web"}},
+				{key: "tier", operator: "!=", values: []string{"db"}},
+			},
+		},
+		{
+			selector: "tier in (a, b),env notin (prod)",
+			want: []*labelRequirement{
+				{key: "tier", operator: "in", values: []string{"a", "b"}},
+				{key: "env", operator: "notin", values: []string{"prod"}},
+			},
+		},
+		{
+			selector: "example.com/team,!canary",
+			want: []*labelRequirement{
+				{key: "example.com/team", operator: "exists"},
+				{key: "canary", operator: "!"},
+			},
+		},
+		{
+			// empty values are valid label values
+			selector: "app=",
+			want:     []*labelRequirement{{key: "app", operator: "=", values: []string{""}}},
+		},
+		{selector: "app=web,", err: true},
+		{selector: "tier in (a,b", err: true},
+		{selector: "tier in a,b)", err: true},
+		{selector: "-app=web", err: true},
+		{selector: "app=web!", err: true},
+		{selector: "Example.com/team", err: true},
+		{selector: "/team", err: true},
+		{selector: "app=" + strings.Repeat("a", 64), err: true},
+		{selector: strings.Repeat("a", 64), err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSelector(tt.selector)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseSelector(%q) succeeded, expected an error", tt.selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSelector(%q): %v", tt.selector, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSelector(%q) = %+v, expected %+v", tt.selector, got, tt.want)
+		}
+	}
+}
+
+func TestCombineSelectors(t *testing.T) {
+	tests := []struct {
+		selectors    []string
+		requirements []string
+		want         []string
+	}{
+		{selectors: []string{"app=web"}, want: []string{"app=web"}},
+		{requirements: []string{"team", "!canary"}, want: []string{"team,!canary"}},
+		{
+			selectors:    []string{"app=web", "app=api"},
+			requirements: []string{"team"},
+			want:         []string{"app=web,team", "app=api,team"},
+		},
+	}
+	for _, tt := range tests {
+		if got := combineSelectors(tt.selectors, tt.requirements); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("combineSelectors(%q, %q) = %q, expected %q", tt.selectors, tt.requirements, got, tt.want)
+		}
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		specs  []string
+		labels bool
+		want   map[string]string
+		err    bool
+	}{
+		{specs: nil, want: map[string]string{}},
+		{specs: []string{"team=a", "example.com/tier=web"}, labels: true, want: map[string]string{"team": "a", "example.com/tier": "web"}},
+		{specs: []string{"note=any value, really"}, want: map[string]string{"note": "any value, really"}},
+		{specs: []string{"note=any value"}, labels: true, err: true},
+		{specs: []string{"team"}, err: true},
+		{specs: []string{"-team=a"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLabels("label", tt.specs, tt.labels)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseLabels(%q) succeeded, expected an error", tt.specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabels(%q): %v", tt.specs, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseLabels(%q) = %v, expected %v", tt.specs, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// shardLabel records the index of the shard that wrote a target, so the
+// targets of shards that no longer run can be collected.
+const shardLabel = "configmap-aggregator/shard"
+
+// shard selects the namespaces one of several aggregator instances handles.
+type shard struct {
+	index int
+	count int
+}
+
+// parseShard parses <index>/<count>, where index counts from 0 like the
+// ordinals of a stateful set.
+func parseShard(s string) (*shard, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid shard %q: expected <index>/<count>", s)
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid shard index %q", parts[0])
+	}
+	count, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid shard count %q", parts[1])
+	}
+	if count < 1 || index < 0 || index >= count {
+		return nil, errors.Errorf("invalid shard %q: index must be from 0 to count-1", s)
+	}
+	return &shard{index: index, count: count}, nil
+}
+
+// owns reports whether namespace belongs to the shard. Without sharding,
+// every namespace does.
+func (s *shard) owns(namespace string) bool {
+	if s == nil {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	return int(h.Sum32()%uint32(s.count)) == s.index
+}
+
+// suffix names the target of a shard, so shards do not overwrite each other.
+func (s *shard) suffix(name string) string {
+	return fmt.Sprintf("%s-%d", name, s.index)
+}
+
+// collects reports whether the shard deletes the stale targets of the shard
+// labeled index. Each shard collects its own, and the first shard those of
+// shards beyond the current count and of runs without sharding.
+func (s *shard) collects(index string) bool {
+	if s == nil {
+		return true
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i >= s.count {
+		return s.index == 0
+	}
+	return i == s.index
+}
+
+// suffixShard names the targets of rules, and the staging config map, after
+// the shard of --shard, so shards do not overwrite each other.
+func suffixShard(rules []*rule) error {
+	if shardSpec == "" {
+		return nil
+	}
+	sh, err := parseShard(shardSpec)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.TargetName != "" {
+			r.TargetName = sh.suffix(r.TargetName)
+		}
+	}
+	if stagingName != "" {
+		stagingName = sh.suffix(stagingName)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot [file] [target-namespace] [target-name]",
+	Short: "save the source config maps of one sync to a local archive",
+	Run:   runSnapshot,
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [file] [target-namespace] [target-name]",
+	Short: "aggregate from a snapshot archive without cluster access",
+	Run:   runReplay,
+}
+
+var (
+	snapshotFile string
+	replayFile   string
+)
+
+// snapshotList is the result of listing a namespace with a selector.
+type snapshotList struct {
+	Namespace string      `json:"namespace"`
+	Selector  string      `json:"selector"`
+	Items     []ConfigMap `json:"items"`
+}
+
+// snapshotArchive is written gzipped JSON. Lists are stored by the query
+// that returned them, so a replay sees exactly what the API server returned
+// without evaluating selectors itself.
+type snapshotArchive struct {
+	Version string         `json:"version"`
+	Created time.Time      `json:"created"`
+	Lists   []snapshotList `json:"lists"`
+}
+
+func snapshotKey(namespace, selector string) string {
+	return namespace + "\x00" + selector
+}
+
+// recordingLister remembers everything listed through it.
+type recordingLister struct {
+	ConfigMapLister
+	mu    sync.Mutex
+	lists map[string]snapshotList
+}
+
+func newRecordingLister(l ConfigMapLister) *recordingLister {
+	return &recordingLister{ConfigMapLister: l, lists: make(map[string]snapshotList)}
+}
+
+func (l *recordingLister) List(namespace, selector string) (*ConfigMapList, error) {
+	list, err := l.ConfigMapLister.List(namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ConfigMap, len(list.Items))
+	copy(items, list.Items)
+	l.mu.Lock()
+	l.lists[snapshotKey(namespace, selector)] = snapshotList{Namespace: namespace, Selector: selector, Items: items}
+	l.mu.Unlock()
+	return list, nil
+}
+
+func (l *recordingLister) write(file string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	archive := snapshotArchive{Version: version, Created: time.Now().UTC()}
+	for _, list := range l.lists {
+		archive.Lists = append(archive.Lists, list)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create snapshot %s", file)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	if err := json.NewEncoder(gz).Encode(&archive); err != nil {
+		return errors.Wrapf(err, "failed to write snapshot %s", file)
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write snapshot %s", file)
+	}
+	return f.Close()
+}
+
+// snapshotLister serves the lists of a snapshot archive.
+type snapshotLister struct {
+	lists map[string]snapshotList
+}
+
+func loadSnapshot(file string) (*snapshotLister, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open snapshot %s", file)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read snapshot %s", file)
+	}
+	var archive snapshotArchive
+	if err := json.NewDecoder(gz).Decode(&archive); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode snapshot %s", file)
+	}
+	log.Printf("replaying snapshot %s taken %s by version %s", file, archive.Created.Format(time.RFC3339), archive.Version)
+
+	l := &snapshotLister{lists: make(map[string]snapshotList, len(archive.Lists))}
+	for _, list := range archive.Lists {
+		l.lists[snapshotKey(list.Namespace, list.Selector)] = list
+	}
+	return l, nil
+}
+
+func (l *snapshotLister) List(namespace, selector string) (*ConfigMapList, error) {
+	list, ok := l.lists[snapshotKey(namespace, selector)]
+	if !ok {
+		return nil, errors.Errorf("namespace %q with selector %q is not in the snapshot", namespace, selector)
+	}
+	items := make([]ConfigMap, len(list.Items))
+	copy(items, list.Items)
+	return &ConfigMapList{Items: items}, nil
+}
+
+// runSnapshot runs one sync in dry run mode and records the sources it
+// lists.
+func runSnapshot(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatal("snapshot file is required")
+	}
+	snapshotFile = args[0]
+	onetime = true
+	dryRun = true
+	runAggregator(cmd, args[1:])
+}
+
+// runReplay runs one sync with the sources of a snapshot instead of the
+// cluster.
+func runReplay(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatal("snapshot file is required")
+	}
+	replayFile = args[0]
+	onetime = true
+	runAggregator(cmd, args[1:])
+}
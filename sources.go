@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// sourcesAnnotation on the target records the version of each source in the
+// aggregate, so it can be checked against the latest version of each.
+const sourcesAnnotation = "configmap-aggregator/sources"
+
+type sourceVersion struct {
+	ResourceVersion string    `json:"resourceVersion"`
+	Seen            time.Time `json:"seen"`
+}
+
+// sourceVersions collects the versions of sources, keyed by namespace/name.
+type sourceVersions map[string]sourceVersion
+
+func (s sourceVersions) add(cm *ConfigMap, now time.Time) {
+	s[cm.Metadata.Namespace+"/"+cm.Metadata.Name] = sourceVersion{
+		ResourceVersion: cm.Metadata.ResourceVersion,
+		Seen:            now,
+	}
+}
+
+func (s sourceVersions) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
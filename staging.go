@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// staged reports whether changes are written to a staging target before
+// they are promoted to the target.
+func (c *controller) staged() bool {
+	return c.stagingName != "" || c.stagingDir != ""
+}
+
+func cloneConfigMap(cm *ConfigMap) (*ConfigMap, error) {
+	b, err := json.Marshal(cm)
+	if err != nil {
+		return nil, err
+	}
+	var clone ConfigMap
+	if err := json.Unmarshal(b, &clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
+// stagingWriter replaces the staging config map, or the files in the staging
+// directory, with an aggregate. Unlike the target, the staging target is only
+// ever written by the aggregator, so it needs none of the merging, checks, and
+// bookkeeping of writing the target.
+type stagingWriter struct {
+	client    *k8sClient
+	namespace string
+	name      string
+	dir       string
+}
+
+func (w *stagingWriter) write(cm *ConfigMap) error {
+	if w.dir != "" {
+		return w.writeFiles(cm)
+	}
+	s, err := cloneConfigMap(cm)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy aggregate")
+	}
+	s.Metadata.Name = w.name
+	s.Metadata.ResourceVersion = ""
+	existing, err := w.client.getConfigMap(w.namespace, w.name)
+	if err == ErrNotExist {
+		return w.client.createConfigMap(s)
+	}
+	if err != nil {
+		return err
+	}
+	s.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+	return w.client.updateConfigMap(s)
+}
+
+// writeFiles writes each key of cm to a file in the staging directory and
+// removes the files it wrote before that are no longer in cm. New files are
+// listed in the state file before they are written, like in the output
+// directory.
+func (w *stagingWriter) writeFiles(cm *ConfigMap) error {
+	state, err := readStateFile(w.dir)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]string, len(cm.Data)+len(state.Files))
+	for k := range cm.Data {
+		listed[k] = ""
+	}
+	for _, f := range state.Files {
+		listed[f] = ""
+	}
+	if err := writeState(w.dir, sortedKeys(listed), nil); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(cm.Data) {
+		if err := writeFileFrom(filepath.Join(w.dir, filepath.FromSlash(k)), strings.NewReader(cm.Data[k])); err != nil {
+			return errors.Wrapf(err, "failed to write %s", k)
+		}
+	}
+	for _, f := range state.Files {
+		if _, ok := cm.Data[f]; !ok {
+			if err := removeFile(w.dir, filepath.Join(w.dir, filepath.FromSlash(f))); err != nil {
+				return errors.Wrapf(err, "failed to remove %s", f)
+			}
+		}
+	}
+	return writeState(w.dir, sortedKeys(cm.Data), nil)
+}
+
+// stage writes a new aggregate to the staging target and reports whether it
+// may be promoted: once promoteAfter has passed since it was staged and the
+// promote webhook, if any, accepts it.
+func (c *controller) stage(cm *ConfigMap) (bool, error) {
+	hash := hashConfigMap(cm)
+	if hash == c.promotedHash {
+		return true, nil
+	}
+
+	if hash != c.stagedHash {
+		w := &stagingWriter{client: c.client, namespace: c.targetNamespace, name: c.stagingName, dir: c.stagingDir}
+		if err := w.write(cm); err != nil {
+			return false, errors.Wrap(err, "failed to write staging target")
+		}
+		c.logf("staged aggregate %s", hash)
+		c.stagedHash = hash
+		c.stagedAt = time.Now()
+		if c.promoteAfter > 0 {
+			time.AfterFunc(c.promoteAfter, c.notify)
+		}
+	}
+
+	if wait := c.promoteAfter - time.Since(c.stagedAt); wait > 0 {
+		c.logf("promoting staged aggregate in %v", wait.Round(time.Second))
+		return false, nil
+	}
+	if c.promoteWebhook != nil {
+		body, err := json.Marshal(&webhookPayload{
+			Rule:      c.name,
+			Namespace: c.targetNamespace,
+			Name:      c.stagingName,
+			Hash:      hash,
+			Time:      time.Now(),
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to encode promote payload")
+		}
+		if err := c.callWebhook(c.promoteWebhook, body); err != nil {
+			return false, errors.Wrap(err, "staged aggregate was not verified")
+		}
+	}
+	return true, nil
+}
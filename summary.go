@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runSummary is written after a onetime run for CI jobs to parse.
+type runSummary struct {
+	Success  bool          `json:"success"`
+	Duration float64       `json:"durationSeconds"`
+	Rules    []ruleSummary `json:"rules"`
+}
+
+type ruleSummary struct {
+	Name      string     `json:"name"`
+	Namespace string     `json:"namespace,omitempty"`
+	Target    string     `json:"target,omitempty"`
+	OutputDir string     `json:"outputDir,omitempty"`
+	Sources   int        `json:"sources"`
+	Keys      int        `json:"keys"`
+	Changes   *changeSet `json:"changes,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Duration  float64    `json:"durationSeconds"`
+}
+
+// summarize returns the summary of the last sync of c.
+func (c *controller) summarize(err error, d time.Duration) ruleSummary {
+	s := ruleSummary{
+		Name:      c.name,
+		Namespace: c.targetNamespace,
+		Target:    c.targetName,
+		OutputDir: c.outputDir,
+		Sources:   c.lastSources,
+		Keys:      c.lastKeys,
+		Changes:   c.lastChanges,
+		Duration:  d.Seconds(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// writeSummary writes the summary as JSON to file, or standard output if it
+// is -.
+func writeSummary(file string, s *runSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode summary")
+	}
+	b = append(b, '\n')
+	if file == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return errors.Wrapf(ioutil.WriteFile(file, b, 0644), "failed to write summary to %s", file)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readTarget returns the current target. Resource targets are presented
+// as a config map holding the data field, output directories as one holding
+// the files.
+func (c *controller) readTarget() (*ConfigMap, error) {
+	if c.outputDir != "" {
+		return c.readFiles()
+	}
+	if c.targetResource == nil {
+		return c.client.getConfigMap(c.targetNamespace, c.targetName)
+	}
+
+	obj, err := c.client.getObject(c.targetResource, c.targetNamespace, c.targetName)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	l := &resourceLister{resource: c.targetResource, field: c.targetField}
+	return l.toConfigMap(raw)
+}
+
+// verifyTarget reads the target back after a write and checks that it holds
+// what was written, catching admission webhooks that mutate the aggregate or
+// writes that were truncated.
+func (c *controller) verifyTarget(cm *ConfigMap) error {
+	actual, err := c.readTarget()
+	if err != nil {
+		return errors.Wrap(err, "failed to read back target")
+	}
+	if !c.configMapsEqual(actual, cm) {
+		return errors.Errorf("target hash %s does not match written hash %s", hashConfigMap(actual), hashConfigMap(cm))
+	}
+	return nil
+}
+
+// drift returns the keys of the target that differ from the aggregate,
+// without writing anything.
+func (c *controller) drift() (*changeSet, error) {
+	cm, err := c.aggregate()
+	if err != nil {
+		return nil, err
+	}
+	if cm == nil {
+		return &changeSet{}, nil
+	}
+	return c.pendingChanges(cm)
+}
+
+// notifyDrift reports keys of the target that differ from cm without writing
+// anything. Webhooks are called once for each new drift.
+func (c *controller) notifyDrift(cm *ConfigMap) error {
+	changes, err := c.pendingChanges(cm)
+	if err != nil {
+		return err
+	}
+	driftedKeys.set(float64(len(changes.keys())), "rule", c.name)
+	if changes.empty() {
+		c.driftHash = ""
+		return nil
+	}
+
+	// the same drift is only reported once
+	hash := hashConfigMap(cm) + "/" + strings.Join(changes.keys(), ",")
+	if hash == c.driftHash {
+		return nil
+	}
+	c.driftHash = hash
+	c.logf("target has drifted: %s", strings.Join(changes.keys(), ", "))
+	c.fireWebhooks(cm, changes, false)
+	return nil
+}
+
+// previewChanges logs the keys of the target that writing cm would change,
+// without writing anything.
+func (c *controller) previewChanges(cm *ConfigMap) error {
+	changes, err := c.pendingChanges(cm)
+	if err != nil {
+		return err
+	}
+	c.lastChanges = changes
+	if changes.empty() {
+		c.logf("dry run: target is up to date")
+		return nil
+	}
+	for _, k := range changes.Added {
+		c.logf("dry run: would add %s", k)
+	}
+	for _, k := range changes.Modified {
+		c.logf("dry run: would modify %s", k)
+	}
+	for _, k := range changes.Removed {
+		c.logf("dry run: would remove %s", k)
+	}
+	return nil
+}
+
+// pendingChanges returns the keys of the target that writing cm would change.
+func (c *controller) pendingChanges(cm *ConfigMap) (*changeSet, error) {
+	existing, err := c.readTarget()
+	if err == ErrNotExist {
+		existing = newConfigMap(c.targetNamespace, c.targetName)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read target")
+	}
+	if c.outputDir == "" && c.targetResource == nil && c.mergesExisting() {
+		// merging modifies cm, which is still to be written
+		if cm, err = cloneConfigMap(cm); err != nil {
+			return nil, errors.Wrap(err, "failed to copy aggregate")
+		}
+		if err := c.mergeExisting(existing, cm); err != nil {
+			return nil, err
+		}
+	}
+	return c.diff(existing, cm), nil
+}
+
+// writeTarget writes cm to the target, retrying when verification of the
+// written data fails. It returns the keys that changed.
+func (c *controller) writeTarget(cm *ConfigMap) (*changeSet, error) {
+	write := c.upsertConfigMap
+	switch {
+	case c.outputDir != "":
+		write = c.writeFiles
+	case c.targetResource != nil:
+		write = c.upsertResource
+	}
+	if !c.verifyWrites {
+		changes, err := write(cm)
+		return changes, c.writeFailed(err)
+	}
+
+	var changes *changeSet
+	var err error
+	for attempt := 0; attempt <= c.verifyRetries; attempt++ {
+		var s *changeSet
+		if s, err = write(cm); err != nil {
+			return nil, c.writeFailed(err)
+		}
+		// a retry only rewrites what was mutated, so keep the original changes
+		if changes == nil {
+			changes = s
+		}
+		if err = c.verifyTarget(cm); err == nil {
+			return changes, nil
+		}
+		c.logf("verification failed: %v", err)
+	}
+
+	verifyFailuresTotal.add(1, "rule", c.name)
+	c.recordEvent("Warning", "VerificationFailed", "target does not match the aggregate after %d attempts: %v", c.verifyRetries+1, err)
+	return nil, err
+}
+
+// writeFailed handles failed writes that need more than logging: a target
+// modified by someone else is retried right away rather than on the next
+// interval, and a target that is too large is recorded as an event.
+func (c *controller) writeFailed(err error) error {
+	switch errors.Cause(err) {
+	case ErrConflict:
+		c.logf("target was modified while writing it, retrying")
+		c.notify()
+	case ErrTooLarge:
+		c.recordEvent("Warning", "TargetTooLarge", "aggregate is too large for the target: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// valueValidator checks a single aggregated value.
+type valueValidator interface {
+	validate(key, value string) error
+}
+
+// keyValidator applies a validator to keys matching a glob pattern.
+type keyValidator struct {
+	pattern   string
+	validator valueValidator
+}
+
+// builtinValidators may be given in place of a schema file or url.
+var builtinValidators = map[string]valueValidator{
+	"grafana-dashboard": grafanaDashboard{},
+}
+
+// parseKeyValidator parses pattern=schema-file or pattern=url. A url is
+// treated as a validation webhook, the name of a builtin validator as that
+// validator, and anything else as a JSON schema file.
+func parseKeyValidator(spec string) (*keyValidator, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.Errorf("invalid validator %q: expected <key-pattern>=<schema-file|url>", spec)
+	}
+	if _, err := path.Match(parts[0], ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid key pattern %q", parts[0])
+	}
+
+	kv := &keyValidator{pattern: parts[0]}
+	if v, ok := builtinValidators[parts[1]]; ok {
+		kv.validator = v
+		return kv, nil
+	}
+	if strings.HasPrefix(parts[1], "http://") || strings.HasPrefix(parts[1], "https://") {
+		kv.validator = &webhookValidator{
+			url:    parts[1],
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		return kv, nil
+	}
+
+	data, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read schema %s", parts[1])
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse schema %s", parts[1])
+	}
+	kv.validator = jsonSchema(schema)
+	return kv, nil
+}
+
+// validateValue runs every validator whose pattern matches key.
+func (c *controller) validateValue(key, value string) error {
+	for _, kv := range c.validators {
+		if ok, _ := path.Match(kv.pattern, key); !ok {
+			continue
+		}
+		if err := kv.validator.validate(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookValidator posts the value to a url. Any 2xx response means the value is valid.
+type webhookValidator struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookValidator) validate(key, value string) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, strings.NewReader(value))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create validation request for %s", w.url)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Aggregator-Key", key)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to call validation webhook %s", w.url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("rejected by %s with HTTP %v: %s", w.url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// grafanaDashboard checks that a value is a dashboard Grafana can provision,
+// either bare or wrapped as {"dashboard": ...} as the HTTP API expects.
+type grafanaDashboard struct{}
+
+func (grafanaDashboard) validate(key, value string) error {
+	var dashboard map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &dashboard); err != nil {
+		return errors.Wrap(err, "dashboard is not a valid JSON object")
+	}
+	if d, ok := dashboard["dashboard"].(map[string]interface{}); ok {
+		dashboard = d
+	}
+	if title, _ := dashboard["title"].(string); strings.TrimSpace(title) == "" {
+		return errors.New("dashboard has no title")
+	}
+	if v, ok := dashboard["uid"]; ok && v != nil {
+		uid, ok := v.(string)
+		if !ok || len(uid) > 40 {
+			return errors.New("dashboard uid must be a string of at most 40 characters")
+		}
+	}
+	for _, field := range []string{"panels", "rows"} {
+		if v, ok := dashboard[field]; ok && v != nil {
+			if _, ok := v.([]interface{}); !ok {
+				return errors.Errorf("dashboard %s must be a list", field)
+			}
+		}
+	}
+	return nil
+}
+
+// jsonSchema validates values against a subset of JSON schema: type, enum,
+// properties, required, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum, and maximum.
+type jsonSchema map[string]interface{}
+
+func (s jsonSchema) validate(key, value string) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return errors.Wrap(err, "value is not valid JSON")
+	}
+	return s.validateValue("$", v)
+}
+
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if t == float64(int64(t)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (s jsonSchema) validateValue(at string, v interface{}) error {
+	if t, ok := s["type"].(string); ok {
+		actual := jsonType(v)
+		if t != actual && !(t == "number" && actual == "integer") {
+			return fmt.Errorf("%s: expected %s, got %s", at, t, actual)
+		}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return s.validateObject(at, t)
+	case []interface{}:
+		if min, ok := s["minItems"].(float64); ok && float64(len(t)) < min {
+			return fmt.Errorf("%s: must have at least %v items", at, min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && float64(len(t)) > max {
+			return fmt.Errorf("%s: must have at most %v items", at, max)
+		}
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range t {
+				if err := jsonSchema(items).validateValue(fmt.Sprintf("%s[%d]", at, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if min, ok := s["minLength"].(float64); ok && float64(len(t)) < min {
+			return fmt.Errorf("%s: must be at least %v characters", at, min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && float64(len(t)) > max {
+			return fmt.Errorf("%s: must be at most %v characters", at, max)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q in schema: %v", at, p, err)
+			}
+			if !re.MatchString(t) {
+				return fmt.Errorf("%s: %q does not match %q", at, t, p)
+			}
+		}
+	case float64:
+		if min, ok := s["minimum"].(float64); ok && t < min {
+			return fmt.Errorf("%s: must be at least %v", at, min)
+		}
+		if max, ok := s["maximum"].(float64); ok && t > max {
+			return fmt.Errorf("%s: must be at most %v", at, max)
+		}
+	}
+	return nil
+}
+
+func (s jsonSchema) validateObject(at string, obj map[string]interface{}) error {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", at, name)
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	for name, v := range obj {
+		prop, ok := properties[name].(map[string]interface{})
+		if !ok {
+			if additional, ok := s["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: unexpected property %q", at, name)
+			}
+			continue
+		}
+		if err := jsonSchema(prop).validateValue(at+"."+name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
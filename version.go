@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// set at build time using -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "print version information",
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Printf("version: %s\ncommit: %s\nbuild date: %s\ngo version: %s\n", version, commit, buildDate, runtime.Version())
+	},
+}
+
+func defaultImage() string {
+	if version == "dev" {
+		return "quay.io/bakins/configmap-aggregator:latest"
+	}
+	return "quay.io/bakins/configmap-aggregator:" + version
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var waitCmd = &cobra.Command{
+	Use:   "wait [target-namespace] [target-name]",
+	Short: "block until the target config map has been written by the aggregator",
+	Run:   runWait,
+}
+
+var (
+	waitAnnotations []string
+	waitCmdTimeout  time.Duration
+)
+
+// waitPollInterval is how often the aggregate is checked while waiting.
+const waitPollInterval = 5 * time.Second
+
+// waitForKeys blocks until every key is in the aggregate, or timeout
+// passes, so an init container can hold back the application until its
+// mandatory configuration exists.
+func (c *controller) waitForKeys(keys []string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var missing []string
+		cm, err := c.aggregate()
+		if err != nil {
+			log.Printf("failed to aggregate %s: %v", c.name, err)
+			missing = keys
+		} else {
+			for _, k := range keys {
+				if cm == nil || !hasKey(cm, k) {
+					missing = append(missing, k)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if time.Now().Add(waitPollInterval).After(deadline) {
+			return errors.Errorf("timed out waiting for keys %s", strings.Join(missing, ", "))
+		}
+		log.Printf("waiting for keys %s in %s", strings.Join(missing, ", "), c.name)
+		time.Sleep(waitPollInterval)
+	}
+}
+
+func hasKey(cm *ConfigMap, key string) bool {
+	if _, ok := cm.Data[key]; ok {
+		return true
+	}
+	_, ok := cm.BinaryData[key]
+	return ok
+}
+
+// hasAnnotations reports whether cm has every annotation, given as key or
+// key=value.
+func hasAnnotations(cm *ConfigMap, annotations []string) bool {
+	for _, a := range annotations {
+		parts := strings.SplitN(a, "=", 2)
+		v, ok := cm.Metadata.Annotations[parts[0]]
+		if !ok || (len(parts) == 2 && v != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// runWait polls the target until it exists and carries the annotations, so
+// an init container of a consuming pod does not race the first aggregation.
+func runWait(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatal("namespace and name of target configmap is required")
+	}
+	client, err := newAPIClient(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deadline := time.Now().Add(waitCmdTimeout)
+	for {
+		cm, err := client.getConfigMap(args[0], args[1])
+		switch {
+		case err == ErrNotExist:
+			log.Printf("waiting for %s/%s to be created", args[0], args[1])
+		case err != nil:
+			log.Printf("failed to get %s/%s: %v", args[0], args[1], err)
+		case hasAnnotations(cm, waitAnnotations):
+			return
+		default:
+			log.Printf("waiting for %s/%s to be written by the aggregator", args[0], args[1])
+		}
+
+		if time.Now().Add(waitPollInterval).After(deadline) {
+			log.Fatalf("timed out waiting for %s/%s", args[0], args[1])
+		}
+		time.Sleep(waitPollInterval)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+// warmUp loads the existing target on startup. Until every source namespace
+// can be listed, keys of the existing target missing from the aggregate are
+// kept, so namespaces that can not be read while the API server recovers do
+// not empty or thrash the target.
+func (c *controller) warmUp() {
+	existing, err := c.readTarget()
+	if err == ErrNotExist {
+		return
+	}
+	if err != nil {
+		c.logf("failed to read the target to warm start from: %v", err)
+		return
+	}
+	data, err := decompressData(existing)
+	if err != nil {
+		c.logf("failed to read the target to warm start from: %v", err)
+		return
+	}
+	c.warm = data
+	c.logf("warm started from %d keys of the existing target", len(data))
+}
+
+// keepWarm adds the keys of the target found on startup that cm is missing,
+// as long as namespaces had to be skipped.
+func (c *controller) keepWarm(cm *ConfigMap) {
+	if c.warm == nil {
+		return
+	}
+	if c.skippedNamespaces == 0 {
+		c.warm = nil
+		return
+	}
+	kept := 0
+	for k, v := range c.warm {
+		if _, ok := cm.Data[k]; !ok {
+			cm.Data[k] = v
+			kept++
+		}
+	}
+	if kept > 0 {
+		c.logf("keeping %d keys of the existing target until all %d skipped namespaces can be listed", kept, c.skippedNamespaces)
+	}
+}
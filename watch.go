@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// watchLoop syncs whenever a watched config map changes. Bursts of events
+// are coalesced into a single sync and writes to the target are spaced at
+// least minWriteInterval apart. A full resync still happens on the rule's
+// interval or schedule in case an event was missed. Sources that can not be
+// watched are only synced on the interval or schedule.
+func (c *controller) watchLoop(done <-chan struct{}) {
+	if w, ok := c.lister.(watcher); ok && watchable(c.lister) {
+		c.queue = newNamespaceQueue()
+		selectors := c.selectors
+		if len(selectors) == 0 {
+			selectors = []string{""}
+		}
+		for _, n := range c.namespaces {
+			for _, s := range selectors {
+				go c.watchNamespace(w, n, s, done)
+			}
+		}
+	} else {
+		c.logf("source does not support watching, falling back to syncing every %v", c.nextSync())
+	}
+
+	for {
+		if err := c.process(); err != nil {
+			c.logf("failed to process config maps: %v", err)
+		}
+
+		select {
+		case <-c.trigger:
+		case <-time.After(c.nextSync()):
+			// the full resync lists every namespace again
+			c.queue.addAll()
+		case <-done:
+			return
+		}
+
+		wait := c.coalesceWindow
+		if d := c.minWriteInterval - time.Since(c.lastWrite); d > wait {
+			wait = d
+		}
+		select {
+		case <-time.After(wait):
+		case <-done:
+			return
+		}
+
+		// events received while waiting are covered by this sync
+		select {
+		case <-c.trigger:
+		default:
+		}
+	}
+}
+
+func (c *controller) watchNamespace(w watcher, namespace, selector string, done <-chan struct{}) {
+	for {
+		err := w.watch(namespace, selector, done, func(e WatchEvent) {
+			if c.ownTarget(&e.Object) || !c.shard.owns(e.Object.Metadata.Namespace) {
+				return
+			}
+			if !c.notifyOnly && !c.dryRun {
+				c.observed.add(&e.Object, time.Now())
+			}
+			// the namespace listed may be all of them
+			c.queue.add(namespace)
+			c.queue.add(e.Object.Metadata.Namespace)
+			c.notify()
+		})
+		if err != nil {
+			c.logf("failed to watch sources in %q: %v", namespace, err)
+		}
+		// events may be missed until the watch is restarted
+		c.queue.addAll()
+
+		select {
+		case <-done:
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
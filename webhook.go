@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// signatureHeader carries the HMAC-SHA256 of the payload, hex encoded and
+// prefixed with sha256=, when a webhook secret is configured.
+const signatureHeader = "X-Aggregator-Signature"
+
+// webhookPayload is posted to webhooks when the target changes.
+type webhookPayload struct {
+	Rule      string     `json:"rule"`
+	Namespace string     `json:"namespace"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Changes   *changeSet `json:"changes"`
+	// set for the call after the first successful sync
+	Initial bool      `json:"initial,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type webhook struct {
+	url    string
+	method string
+	client *http.Client
+	// status codes that count as success. any 2xx when empty.
+	codes []int
+	// substring the response body must contain
+	body string
+	// field in a JSON response body that must equal value
+	field []string
+	value string
+	// only call the webhook when keys matching these patterns change
+	keys []string
+	// files holding credentials, read on every call so they can be rotated
+	bearerTokenFile string
+	basicAuthFile   string
+}
+
+// transport returns the transport for a webhook with a private CA, client
+// certificate, or proxy. Without a proxy option, the HTTP_PROXY, HTTPS_PROXY,
+// and NO_PROXY environment variables apply.
+func transport(caFile, certFile, keyFile, proxy string) (*http.Transport, error) {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     &tls.Config{},
+	}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy %q", proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s", caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("cert-file and key-file must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// parseWebhook parses a url followed by whitespace separated options:
+// codes=200,202 body=<substring> field=<path>:<value> timeout=<duration>
+// keys=<pattern>,<pattern> bearer-token-file=<file> basic-auth-file=<file>
+// method=<method> ca-file=<file> cert-file=<file> key-file=<file> proxy=<url>
+func parseWebhook(spec string) (*webhook, error) {
+	parts := strings.Fields(spec)
+	if len(parts) == 0 {
+		return nil, errors.New("empty webhook")
+	}
+
+	w := &webhook{
+		url:    parts[0],
+		method: http.MethodPost,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	var caFile, certFile, keyFile, proxy string
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.Errorf("invalid webhook option %q: expected <name>=<value>", opt)
+		}
+		switch kv[0] {
+		case "codes":
+			for _, s := range strings.Split(kv[1], ",") {
+				code, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid status code %q", s)
+				}
+				w.codes = append(w.codes, code)
+			}
+		case "body":
+			w.body = kv[1]
+		case "field":
+			fv := strings.SplitN(kv[1], ":", 2)
+			if len(fv) != 2 {
+				return nil, errors.Errorf("invalid webhook field %q: expected <path>:<value>", kv[1])
+			}
+			field, err := parseFieldPath(fv[0])
+			if err != nil {
+				return nil, err
+			}
+			w.field = field
+			w.value = fv[1]
+		case "keys":
+			for _, p := range strings.Split(kv[1], ",") {
+				if _, err := path.Match(p, ""); err != nil {
+					return nil, errors.Wrapf(err, "invalid key pattern %q", p)
+				}
+				w.keys = append(w.keys, p)
+			}
+		case "timeout":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid webhook timeout %q", kv[1])
+			}
+			w.client.Timeout = d
+		case "method":
+			switch m := strings.ToUpper(kv[1]); m {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+				w.method = m
+			default:
+				return nil, errors.Errorf("invalid webhook method %q: expected POST, PUT, or PATCH", kv[1])
+			}
+		case "bearer-token-file":
+			w.bearerTokenFile = kv[1]
+		case "basic-auth-file":
+			w.basicAuthFile = kv[1]
+		case "ca-file":
+			caFile = kv[1]
+		case "cert-file":
+			certFile = kv[1]
+		case "key-file":
+			keyFile = kv[1]
+		case "proxy":
+			proxy = kv[1]
+		default:
+			return nil, errors.Errorf("unknown webhook option %q", kv[0])
+		}
+	}
+	if caFile != "" || certFile != "" || keyFile != "" || proxy != "" {
+		t, err := transport(caFile, certFile, keyFile, proxy)
+		if err != nil {
+			return nil, err
+		}
+		w.client.Transport = t
+	}
+	return w, nil
+}
+
+func (w *webhook) success(code int) bool {
+	if len(w.codes) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, c := range w.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// check applies the success criteria to a response.
+func (w *webhook) check(resp *http.Response) error {
+	if !w.success(resp.StatusCode) {
+		return errors.Errorf("webhook %s returned HTTP %v", w.url, resp.StatusCode)
+	}
+	if w.body == "" && w.field == nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read response from webhook %s", w.url)
+	}
+	if w.body != "" && !strings.Contains(string(data), w.body) {
+		return errors.Errorf("webhook %s response does not contain %q", w.url, w.body)
+	}
+	if w.field != nil {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return errors.Wrapf(err, "failed to parse response from webhook %s", w.url)
+		}
+		v, ok := getField(obj, w.field)
+		if !ok || fmt.Sprint(v) != w.value {
+			return errors.Errorf("webhook %s response field %s is not %q", w.url, strings.Join(w.field, "."), w.value)
+		}
+	}
+	return nil
+}
+
+// authorize sets credentials on a request. A basic auth file holds
+// <user>:<password>.
+func (w *webhook) authorize(req *http.Request) error {
+	if w.bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(w.bearerTokenFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read bearer token for %s", w.url)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	if w.basicAuthFile != "" {
+		data, err := ioutil.ReadFile(w.basicAuthFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read basic auth for %s", w.url)
+		}
+		parts := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid basic auth file %s: expected <user>:<password>", w.basicAuthFile)
+		}
+		req.SetBasicAuth(parts[0], parts[1])
+	}
+	return nil
+}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *controller) callWebhook(w *webhook, body []byte) error {
+	req, err := http.NewRequest(w.method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create request for %s", w.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := w.authorize(req); err != nil {
+		return err
+	}
+	if len(c.webhookSecret) > 0 {
+		req.Header.Set(signatureHeader, sign(c.webhookSecret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to call webhook %s", w.url)
+	}
+	defer resp.Body.Close()
+
+	return w.check(resp)
+}
+
+// fireWebhooks notifies webhooks that the target changed, unless only
+// insignificant keys changed. Webhooks scoped to key patterns are only called
+// when a matching key changed, and only see those changes, unless this is the
+// initial call. Failures are logged but do not fail the sync, as the target
+// has already been written.
+func (c *controller) fireWebhooks(cm *ConfigMap, changes *changeSet, initial bool) {
+	if len(c.webhooks) == 0 {
+		return
+	}
+	significant := changes.filter(c.significantKeys)
+	if significant.empty() && !initial {
+		c.logf("only insignificant keys changed, not calling webhooks: %s", strings.Join(changes.keys(), ", "))
+		return
+	}
+	changes = significant
+
+	hash := hashConfigMap(cm)
+	for _, w := range c.webhooks {
+		s := changes.filter(w.keys)
+		if s.empty() && !initial {
+			continue
+		}
+
+		body, err := json.Marshal(&webhookPayload{
+			Rule:      c.name,
+			Namespace: c.targetNamespace,
+			Name:      c.targetName,
+			Hash:      hash,
+			Changes:   s,
+			Initial:   initial,
+			Time:      time.Now(),
+		})
+		if err != nil {
+			c.logf("failed to encode webhook payload: %v", err)
+			return
+		}
+
+		if err := c.callWebhook(w, body); err != nil {
+			webhooksTotal.add(1, "rule", c.name, "result", "failure")
+			c.logf("%v", err)
+			continue
+		}
+		webhooksTotal.add(1, "rule", c.name, "result", "success")
+	}
+}
+
+// healthPayload is posted to the health notifiers when the aggregation
+// becomes unhealthy or recovers.
+type healthPayload struct {
+	Rule    string    `json:"rule"`
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// notifyHealth calls the unhealthy webhook after unhealthyAfter consecutive
+// failed syncs, and the healthy webhook on the first success after that, so
+// external systems can drain traffic from consumers with stale config. A
+// failed call is retried after the next sync.
+func (c *controller) notifyHealth(syncErr error) {
+	if syncErr != nil {
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+
+	var w *webhook
+	healthy := syncErr == nil
+	switch {
+	case !healthy && !c.unhealthy && c.unhealthyAfter > 0 && c.failures >= c.unhealthyAfter:
+		w = c.unhealthyWebhook
+	case healthy && c.unhealthy:
+		w = c.healthyWebhook
+	default:
+		return
+	}
+
+	if w != nil {
+		p := &healthPayload{
+			Rule:    c.name,
+			Healthy: healthy,
+			Time:    time.Now(),
+		}
+		if syncErr != nil {
+			p.Error = syncErr.Error()
+		}
+		body, err := json.Marshal(p)
+		if err != nil {
+			c.logf("failed to encode health payload: %v", err)
+			return
+		}
+		if err := c.callWebhook(w, body); err != nil {
+			webhooksTotal.add(1, "rule", c.name, "result", "failure")
+			c.logf("%v", err)
+			return
+		}
+		webhooksTotal.add(1, "rule", c.name, "result", "success")
+	}
+	c.unhealthy = !healthy
+}
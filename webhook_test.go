@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWebhook(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    webhook
+		timeout time.Duration
+		err     bool
+	}{
+		{
+			spec:    "http://example.com/hook",
+			want:    webhook{url: "http://example.com/hook", method: http.MethodPost},
+			timeout: 10 * time.Second,
+		},
+		{
+			spec: "http://example.com/hook codes=200,202 body=ok field=.status.phase:Ready keys=*.conf,app/* timeout=5s method=put bearer-token-file=/token basic-auth-file=/auth",
+			want: webhook{
+				url:             "http://example.com/hook",
+				method:          http.MethodPut,
+				codes:           []int{200, 202},
+				body:            "ok",
+				field:           []string{"status", "phase"},
+				value:           "Ready",
+				keys:            []string{"*.conf", "app/*"},
+				bearerTokenFile: "/token",
+				basicAuthFile:   "/auth",
+			},
+			timeout: 5 * time.Second,
+		},
+		{
+			// values may contain = and :
+			spec:    "http://example.com/hook body=a=b field=ok:x:y",
+			want:    webhook{url: "http://example.com/hook", method: http.MethodPost, body: "a=b", field: []string{"ok"}, value: "x:y"},
+			timeout: 10 * time.Second,
+		},
+		{spec: "", err: true},
+		{spec: "   ", err: true},
+		{spec: "http://example.com/hook codes", err: true},
+		{spec: "http://example.com/hook codes=", err: true},
+		{spec: "http://example.com/hook codes=2xx", err: true},
+		{spec: "http://example.com/hook field=.status", err: true},
+		{spec: "http://example.com/hook field=:x", err: true},
+		{spec: "http://example.com/hook keys=[", err: true},
+		{spec: "http://example.com/hook timeout=5", err: true},
+		{spec: "http://example.com/hook method=GET", err: true},
+		{spec: "http://example.com/hook retries=3", err: true},
+		{spec: "http://example.com/hook ca-file=/does/not/exist", err: true},
+		{spec: "http://example.com/hook cert-file=/cert", err: true},
+		{spec: "http://example.com/hook proxy=%zz", err: true},
+	}
+	for _, tt := range tests {
+		w, err := parseWebhook(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseWebhook(%q) succeeded, expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWebhook(%q): %v", tt.spec, err)
+			continue
+		}
+		if w.client.Timeout != tt.timeout {
+			t.Errorf("parseWebhook(%q) timeout = %v, expected %v", tt.spec, w.client.Timeout, tt.timeout)
+		}
+		got := *w
+		got.client = nil
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWebhook(%q) = %+v, expected %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseWebhookProxy(t *testing.T) {
+	w, err := parseWebhook("http://example.com/hook proxy=http://proxy:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, ok := w.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport is %T, expected *http.Transport", w.client.Transport)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/hook", nil)
+	u, err := tr.Proxy(req)
+	if err != nil || u == nil || u.Host != "proxy:3128" {
+		t.Errorf("proxy of webhook = %v, %v, expected proxy:3128", u, err)
+	}
+}
+
+func TestWebhookCheck(t *testing.T) {
+	tests := []struct {
+		spec string
+		code int
+		body string
+		err  bool
+	}{
+		{spec: "http://h", code: 204},
+		{spec: "http://h", code: 302, err: true},
+		{spec: "http://h codes=302", code: 302},
+		{spec: "http://h codes=302", code: 200, err: true},
+		{spec: "http://h body=ok", code: 200, body: "all ok"},
+		{spec: "http://h body=ok", code: 200, body: "failed", err: true},
+		{spec: "http://h field=.status.ready:true", code: 200, body: `{"status": {"ready": true}}`},
+		{spec: "http://h field=.status.ready:true", code: 200, body: `{"status": {"ready": false}}`, err: true},
+		{spec: "http://h field=.status.ready:true", code: 200, body: `{"status": {}}`, err: true},
+		{spec: "http://h field=.status.ready:true", code: 200, body: `ready`, err: true},
+	}
+	for _, tt := range tests {
+		w, err := parseWebhook(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{StatusCode: tt.code, Body: ioutil.NopCloser(strings.NewReader(tt.body))}
+		if err := w.check(resp); (err != nil) != tt.err {
+			t.Errorf("check of %q with HTTP %d %q: %v, expected an error: %v", tt.spec, tt.code, tt.body, err, tt.err)
+		}
+	}
+}
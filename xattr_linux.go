@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// setContentType records the content type of a file in the user.mime_type
+// extended attribute, which some tools use to dispatch on.
+func setContentType(name, contentType string) error {
+	return syscall.Setxattr(name, "user.mime_type", []byte(contentType), 0)
+}
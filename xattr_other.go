@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// setContentType is only supported on linux.
+func setContentType(name, contentType string) error {
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Parsed documents are written back as block style YAML for readability.
+
+var plainYAMLKey = regexp.MustCompile(`^[A-Za-z_][-A-Za-z0-9_./]*$`)
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		// JSON strings are valid double quoted YAML scalars
+		b, _ := json.Marshal(v)
+		return string(b)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func yamlKey(k string) string {
+	if plainYAMLKey.MatchString(k) {
+		return k
+	}
+	return yamlScalar(k)
+}
+
+// isYAMLBlock reports whether v is written as a nested block.
+func isYAMLBlock(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+func writeYAML(buf *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !isYAMLBlock(v[k]) {
+				buf.WriteString(pad + yamlKey(k) + ": " + yamlScalar(v[k]) + "\n")
+				continue
+			}
+			buf.WriteString(pad + yamlKey(k) + ":\n")
+			writeYAML(buf, v[k], indent+2)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !isYAMLBlock(item) {
+				buf.WriteString(pad + "- " + yamlScalar(item) + "\n")
+				continue
+			}
+			// write the item indented, then put the dash on its first line
+			var child bytes.Buffer
+			writeYAML(&child, item, indent+2)
+			b := child.Bytes()
+			buf.WriteString(pad + "- ")
+			buf.Write(b[indent+2:])
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// toYAML returns v as a YAML document.
+func toYAML(v interface{}) string {
+	var buf bytes.Buffer
+	writeYAML(&buf, v, 0)
+	return buf.String()
+}
+
+// parseJSONDocument parses a JSON value, keeping numbers as written.
+func parseJSONDocument(s string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseYAMLDocument parses a YAML document, or a JSON one keeping numbers as
+// written, into the same types as parseJSONDocument.
+func parseYAMLDocument(s string) (interface{}, error) {
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		return parseJSONDocument(s)
+	}
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return nil, err
+	}
+	return yamlObjects(v), nil
+}
+
+// yamlObjects converts the mappings of a parsed YAML document, which may have
+// keys of any type, to objects with string keys.
+func yamlObjects(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			m[fmt.Sprint(k)] = yamlObjects(x)
+		}
+		return m
+	case []interface{}:
+		for i, x := range v {
+			v[i] = yamlObjects(x)
+		}
+	}
+	return v
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestToYAML(t *testing.T) {
+	tests := []struct {
+		json string
+		want string
+	}{
+		{json: `"a"`, want: "\"a\"\n"},
+		{json: `{"b": 2, "a": [1, "x", true, null], "c": {}}`, want: "a:\n  - 1\n  - \"x\"\n  - true\n  - null\nb: 2\nc: {}\n"},
+		{json: `{"a b": {"c": 1.50}}`, want: "\"a b\":\n  c: 1.50\n"},
+		{json: `[{"name": "x", "rules": [{"alert": "y"}]}, []]`, want: "- name: \"x\"\n  rules:\n    - alert: \"y\"\n- []\n"},
+	}
+	for _, tt := range tests {
+		v, err := parseJSONDocument(tt.json)
+		if err != nil {
+			t.Errorf("parseJSONDocument(%q): %v", tt.json, err)
+			continue
+		}
+		if got := toYAML(v); got != tt.want {
+			t.Errorf("toYAML(%s) = %q, expected %q", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLDocument(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want interface{}
+		err  bool
+	}{
+		{doc: `{"a": 1.0}`, want: map[string]interface{}{"a": json.Number("1.0")}},
+		{doc: "a:\n  b: [x, z]\n  1: true\n", want: map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{"x", "z"}, "1": true}}},
+		{doc: "- a: 1\n", want: []interface{}{map[string]interface{}{"a": 1}}},
+		{doc: "a: [", err: true},
+		{doc: `{"a": `, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseYAMLDocument(tt.doc)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseYAMLDocument(%q) succeeded, expected an error", tt.doc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseYAMLDocument(%q): %v", tt.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseYAMLDocument(%q) = %#v, expected %#v", tt.doc, got, tt.want)
+		}
+	}
+}